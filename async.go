@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//队列满时的处理策略
+type OverflowPolicy int
+
+const (
+	OverflowBlock      OverflowPolicy = iota //阻塞等待
+	OverflowDropNewest                       //丢弃新日志
+	OverflowDropLevel                        //优先丢弃低级别日志
+)
+
+//解析配置文件中asyncpolicy
+func overflowPolicyforCfg(policy string) OverflowPolicy {
+	switch strings.ToLower(policy) {
+	case "dropnewest":
+		return OverflowDropNewest
+	case "droplevel":
+		return OverflowDropLevel
+	default:
+		return OverflowBlock
+	}
+}
+
+type asyncEntry struct {
+	data    []byte
+	level   logrus.Level
+	written chan struct{} //Fatal/Panic等待写入完成
+}
+
+//entryWriter 批量写入时保留日志条目边界，按条数切分的LogFile不会把一条日志拆到两个文件
+type entryWriter interface {
+	WriteEntries(entries [][]byte) (int, error)
+}
+
+//AsyncWriter 异步写日志：有界队列加单个写协程批量写入
+//Error及以上级别日志不会被丢弃，Fatal/Panic等待写入完成后返回
+type AsyncWriter struct {
+	writer   io.Writer
+	policy   OverflowPolicy
+	capacity int
+	lock     sync.Mutex
+	cond     *sync.Cond
+	queue    []asyncEntry
+	dropped  uint64
+	closed   bool
+	done     chan struct{}
+	id       uint64 //指标编号
+}
+
+func NewAsyncWriter(writer io.Writer, capacity int, policy OverflowPolicy) *AsyncWriter {
+	if capacity <= 0 {
+		capacity = 1024
+	}
+	w := &AsyncWriter{
+		writer:   writer,
+		policy:   policy,
+		capacity: capacity,
+		queue:    make([]asyncEntry, 0, capacity),
+		done:     make(chan struct{}),
+		id:       nextMetricsID(),
+	}
+	w.cond = sync.NewCond(&w.lock)
+	asyncwriters.Lock()
+	asyncwriters.m[w] = struct{}{}
+	asyncwriters.Unlock()
+	go w.run()
+	return w
+}
+
+//Dropped 已丢弃的日志条数
+func (w *AsyncWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+//QueueLen 队列中等待写入的日志条数
+func (w *AsyncWriter) QueueLen() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.queue)
+}
+
+func (w *AsyncWriter) Write(data []byte) (n int, e error) {
+	level, ok := lineLevel(data)
+	if !ok {
+		level = logrus.PanicLevel //无法识别时按不可丢弃处理
+	}
+	//logrus会复用buffer，需要拷贝
+	buf := make([]byte, len(data))
+	copy(buf, data)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	for len(w.queue) >= w.capacity && !w.closed {
+		if w.policy == OverflowDropLevel && w.evict(level) {
+			break
+		}
+		if w.policy != OverflowBlock && droppable(level) {
+			atomic.AddUint64(&w.dropped, 1)
+			return len(data), nil
+		}
+		w.cond.Wait()
+	}
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	entry := asyncEntry{data: buf, level: level}
+	//Fatal/Panic后进程退出，必须等待写入
+	if level <= logrus.FatalLevel {
+		entry.written = make(chan struct{})
+	}
+	w.queue = append(w.queue, entry)
+	w.cond.Broadcast()
+	if entry.written != nil {
+		w.lock.Unlock()
+		<-entry.written
+		w.lock.Lock()
+	}
+	return len(data), nil
+}
+
+//evict 丢弃队列中级别最低且不高于level的日志，调用前需持有lock
+func (w *AsyncWriter) evict(level logrus.Level) bool {
+	victim := -1
+	for i, entry := range w.queue {
+		if droppable(entry.level) && entry.level >= level &&
+			(victim < 0 || entry.level > w.queue[victim].level) {
+			victim = i
+		}
+	}
+	if victim < 0 {
+		return false
+	}
+	w.queue = append(w.queue[:victim], w.queue[victim+1:]...)
+	atomic.AddUint64(&w.dropped, 1)
+	return true
+}
+
+func (w *AsyncWriter) run() {
+	defer close(w.done)
+	var buf bytes.Buffer
+	var entries [][]byte
+	for {
+		w.lock.Lock()
+		for len(w.queue) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if len(w.queue) == 0 {
+			w.lock.Unlock()
+			return
+		}
+		batch := w.queue
+		w.queue = make([]asyncEntry, 0, w.capacity)
+		w.cond.Broadcast()
+		w.lock.Unlock()
+
+		var err error
+		if ew, ok := w.writer.(entryWriter); ok {
+			entries = entries[:0]
+			for _, entry := range batch {
+				entries = append(entries, entry.data)
+			}
+			_, err = ew.WriteEntries(entries)
+		} else {
+			buf.Reset()
+			for _, entry := range batch {
+				buf.Write(entry.data)
+			}
+			_, err = w.writer.Write(buf.Bytes())
+		}
+		if err != nil {
+			stdlog.Println("async write log error: ", err)
+		}
+		for _, entry := range batch {
+			if entry.written != nil {
+				close(entry.written)
+			}
+		}
+	}
+}
+
+//Close 写完队列中的日志后关闭底层writer，之后的写入返回os.ErrClosed
+func (w *AsyncWriter) Close() error {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.cond.Broadcast()
+	w.lock.Unlock()
+	<-w.done
+	asyncwriters.Lock()
+	delete(asyncwriters.m, w)
+	asyncwriters.Unlock()
+	if closer, ok := w.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+//Error及以上级别的日志不能丢弃
+func droppable(level logrus.Level) bool {
+	return level > logrus.ErrorLevel
+}
+
+//lineLevel 从Formatter输出的日志行中解析日志级别
+func lineLevel(data []byte) (logrus.Level, bool) {
+	idx := bytes.Index(data, []byte("[LOG"))
+	if idx < 0 || idx+8 > len(data) || data[idx+7] != ']' {
+		return logrus.PanicLevel, false
+	}
+	switch string(data[idx+1 : idx+7]) {
+	case "LOGTRC":
+		return logrus.TraceLevel, true
+	case "LOGDBG":
+		return logrus.DebugLevel, true
+	case "LOGINF":
+		return logrus.InfoLevel, true
+	case "LOGWAN":
+		return logrus.WarnLevel, true
+	case "LOGERR":
+		return logrus.ErrorLevel, true
+	case "LOGFAT":
+		return logrus.FatalLevel, true
+	case "LOGPAC":
+		return logrus.PanicLevel, true
+	}
+	return logrus.PanicLevel, false
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+//gateWriter 第一次写入阻塞到release，用于让AsyncWriter的队列按预期堆积
+type gateWriter struct {
+	lock    sync.Mutex
+	buf     bytes.Buffer
+	started chan struct{}
+	gate    chan struct{}
+	once    sync.Once
+	closed  bool
+}
+
+func newGateWriter() *gateWriter {
+	return &gateWriter{started: make(chan struct{}), gate: make(chan struct{})}
+}
+
+func (w *gateWriter) Write(data []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.started)
+		<-w.gate
+	})
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.buf.Write(data)
+}
+
+func (w *gateWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.closed = true
+	return nil
+}
+
+func (w *gateWriter) release() {
+	close(w.gate)
+}
+
+func (w *gateWriter) String() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.buf.String()
+}
+
+//blockRun 写入一条日志并等待写协程阻塞在底层writer中
+func blockRun(t *testing.T, w *AsyncWriter, gw *gateWriter) {
+	t.Helper()
+	w.Write([]byte("[LOGINF] first\n"))
+	select {
+	case <-gw.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer goroutine not started")
+	}
+}
+
+func TestAsyncDropLevelEvictsLowerLevels(t *testing.T) {
+	gw := newGateWriter()
+	w := NewAsyncWriter(gw, 2, OverflowDropLevel)
+	blockRun(t, w, gw)
+
+	w.Write([]byte("[LOGDBG] debug\n"))
+	w.Write([]byte("[LOGINF] info\n"))
+	//队列已满：Warn挤掉Debug，Error挤掉Info，Trace没有可挤掉的日志，丢弃自身
+	w.Write([]byte("[LOGWAN] warn\n"))
+	w.Write([]byte("[LOGERR] error\n"))
+	w.Write([]byte("[LOGTRC] trace\n"))
+	if dropped := w.Dropped(); dropped != 3 {
+		t.Errorf("dropped %d, want 3", dropped)
+	}
+
+	gw.release()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := "[LOGINF] first\n[LOGWAN] warn\n[LOGERR] error\n"
+	if got := gw.String(); got != want {
+		t.Fatalf("written %q, want %q", got, want)
+	}
+}
+
+func TestAsyncFatalWaitsForWrite(t *testing.T) {
+	gw := newGateWriter()
+	w := NewAsyncWriter(gw, 16, OverflowDropNewest)
+	defer w.Close()
+	blockRun(t, w, gw)
+
+	returned := make(chan struct{})
+	go func() {
+		w.Write([]byte("[LOGFAT] fatal\n"))
+		close(returned)
+	}()
+	select {
+	case <-returned:
+		t.Fatal("fatal returned before it was written")
+	case <-time.After(50 * time.Millisecond):
+	}
+	gw.release()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fatal not returned after write")
+	}
+	if got := gw.String(); got != "[LOGINF] first\n[LOGFAT] fatal\n" {
+		t.Fatalf("written %q", got)
+	}
+}
+
+func TestAsyncCloseDrainsQueue(t *testing.T) {
+	gw := newGateWriter()
+	w := NewAsyncWriter(gw, 16, OverflowBlock)
+	blockRun(t, w, gw)
+	w.Write([]byte("[LOGINF] a\n"))
+	w.Write([]byte("[LOGINF] b\n"))
+
+	closed := make(chan error)
+	go func() {
+		closed <- w.Close()
+	}()
+	gw.release()
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	if got := gw.String(); got != "[LOGINF] first\n[LOGINF] a\n[LOGINF] b\n" {
+		t.Fatalf("written %q", got)
+	}
+	if !gw.closed {
+		t.Error("underlying writer not closed")
+	}
+	if n, err := w.Write([]byte("[LOGERR] late\n")); n != 0 || err != os.ErrClosed {
+		t.Fatalf("write after close: n=%d err=%v", n, err)
+	}
+	if got := gw.String(); got != "[LOGINF] first\n[LOGINF] a\n[LOGINF] b\n" {
+		t.Fatalf("written after close %q", got)
+	}
+}
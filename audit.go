@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	auditField = " hmac=" //每行末尾的HMAC字段
+	chainField = "chain=" //header中上一个文件最后一行的HMAC
+)
+
+//SetAudit 开启审计模式：每行末尾追加hmac=HMAC-SHA256(key, 上一行hmac+本行内容)，
+//header中记录上一个文件最后一行的hmac，切分、重启后链不中断，使用VerifyAudit校验；key为nil关闭
+//开启后自动写入header/footer，多进程共享模式下不支持
+func (logfile *LogFile) SetAudit(key []byte) {
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	logfile.auditkey = key
+	if key != nil {
+		logfile.meta = true
+		if logfile.file != nil {
+			logfile.scanSegment(logfile.file)
+		}
+	}
+}
+
+//LoadKeyFile 读取密钥文件，忽略首尾空白
+func LoadKeyFile(fpath string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("key file %s is empty", fpath)
+	}
+	return key, nil
+}
+
+//chainSum 计算一行的hmac
+func chainSum(key []byte, prev []byte, line []byte) []byte {
+	if prev == nil {
+		prev = make([]byte, sha256.Size)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(prev)
+	mac.Write(line)
+	return mac.Sum(nil)
+}
+
+//tornSum 不完整行标记的hmac：串联不完整行的内容和标记内容，标记行推进链
+func tornSum(key []byte, prev []byte, fragment []byte, content []byte) []byte {
+	data := make([]byte, 0, len(fragment)+1+len(content))
+	data = append(data, fragment...)
+	data = append(data, '\n')
+	data = append(data, content...)
+	return chainSum(key, prev, data)
+}
+
+//chainHex 链上的hmac，文件链开头为全0
+func chainHex(sum []byte) string {
+	if sum == nil {
+		sum = make([]byte, sha256.Size)
+	}
+	return hex.EncodeToString(sum)
+}
+
+//chainLines 从chain开始为每行追加hmac并返回最后一行的hmac，批量写入可能拆分到多个文件，写入后由record推进链，调用前需持有lock
+func (logfile *LogFile) chainLines(chain []byte, data []byte) ([]byte, []byte) {
+	out := make([]byte, 0, len(data)+len(auditField)+2*sha256.Size+1)
+	for len(data) > 0 {
+		line := data
+		if idx := bytes.IndexByte(data, '\n'); idx >= 0 {
+			line, data = data[:idx], data[idx+1:]
+		} else {
+			data = nil
+		}
+		chain = chainSum(logfile.auditkey, chain, line)
+		out = append(out, line...)
+		out = append(out, auditField...)
+		out = append(out, chainHex(chain)...)
+		out = append(out, '\n')
+	}
+	return out, chain
+}
+
+//splitAudit 拆分日志内容和hmac
+func splitAudit(line []byte) (content []byte, sum []byte, ok bool) {
+	idx := bytes.LastIndex(line, []byte(auditField))
+	if idx < 0 {
+		return line, nil, false
+	}
+	sum, err := hex.DecodeString(string(line[idx+len(auditField):]))
+	if err != nil || len(sum) != sha256.Size {
+		return line, nil, false
+	}
+	return line[:idx], sum, true
+}
+
+//headerChain 解析header中的chain
+func headerChain(line string) ([]byte, bool) {
+	for _, field := range strings.Fields(line) {
+		if strings.HasPrefix(field, chainField) {
+			sum, err := hex.DecodeString(strings.TrimPrefix(field, chainField))
+			return sum, err == nil && len(sum) == sha256.Size
+		}
+	}
+	return nil, false
+}
+
+//headerField 解析header中的key=value
+func headerField(line string, key string) string {
+	for _, field := range strings.Fields(line) {
+		if strings.HasPrefix(field, key+"=") {
+			return strings.TrimPrefix(field, key+"=")
+		}
+	}
+	return ""
+}
+
+//resumeChain 重启后从最后一个已存在的日志文件(含压缩文件)中恢复链，调用前需持有lock
+func (logfile *LogFile) resumeChain() {
+	if logfile.auditkey == nil || logfile.chain != nil {
+		return
+	}
+	own := logfile.naming.ownRegexp(logfile.backendname, logfile.servicename)
+	segments, err := listSegments(logfile.fs, logfile.filepath, logfile.naming, own)
+	if err != nil {
+		return
+	}
+	var mine []segment
+	for _, seg := range segments {
+		if seg.own {
+			mine = append(mine, seg)
+		}
+	}
+	if len(mine) == 0 {
+		return
+	}
+	sortByName(mine)
+	last := mine[len(mine)-1]
+	logfile.prevseg = segmentBase(last.path)
+	r, err := openSegment(logfile.fs, last.path, logfile.keys)
+	if err != nil {
+		stdlog.Println("resume audit chain error: ", err)
+		return
+	}
+	defer r.Close()
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		line = bytes.TrimSuffix(line, []byte{'\n'})
+		if bytes.HasPrefix(line, []byte(headerPrefix)) {
+			if sum, ok := headerChain(string(line)); ok {
+				logfile.chain = sum
+			}
+		} else if _, sum, ok := splitAudit(line); ok && (!isMetaLine(line) || bytes.HasPrefix(line, []byte(tornPrefix))) {
+			logfile.chain = sum
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+//openSegment 打开日志文件，压缩文件按后缀解压，加密文件使用keys解密
+func openSegment(fs FileSystem, fpath string, keys KeyProvider) (io.ReadCloser, error) {
+	file, err := fs.OpenFile(fpath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	seg := &segmentReader{file: file}
+	var r io.Reader = file
+	for format, ext := range compressExt {
+		if strings.HasSuffix(fpath, ext) {
+			zr, err := newDecompressReader(file, format)
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+			seg.zr = zr
+			r = zr
+		}
+	}
+	br := bufio.NewReader(r)
+	seg.r = br
+	if _, ok := encryptedKeyID(br); ok {
+		if keys == nil {
+			seg.Close()
+			return nil, fmt.Errorf("%s is encrypted, key required", fpath)
+		}
+		seg.r = newDecryptReader(br, keys, segmentBase(fpath))
+	}
+	return seg, nil
+}
+
+type segmentReader struct {
+	r    io.Reader
+	zr   io.ReadCloser
+	file File
+}
+
+func (seg *segmentReader) Read(p []byte) (int, error) {
+	return seg.r.Read(p)
+}
+
+func (seg *segmentReader) Close() error {
+	if seg.zr != nil {
+		seg.zr.Close()
+	}
+	return seg.file.Close()
+}
+
+//AuditBreak 审计链校验失败的位置
+type AuditBreak struct {
+	Path   string
+	Line   int
+	Reason string
+}
+
+func (b *AuditBreak) Error() string {
+	return fmt.Sprintf("%s:%d: %s", b.Path, b.Line, b.Reason)
+}
+
+//AuditReport 审计链校验结果，Break为nil表示校验通过
+type AuditReport struct {
+	Segments int
+	Lines    int
+	Break    *AuditBreak
+}
+
+//VerifyAudit 按序号遍历审计日志文件，校验hmac链，返回第一个被修改、删除的行或缺失的文件
+//目录中最早的文件视为链的起点(更早的文件可能已被清理)，nameformat为空使用默认模板，keys用于解密加密的文件
+//footer只能是非最新文件的最后一行，不完整行的标记只能紧跟在不完整的行之后，两者的hmac都需校验通过
+func VerifyAudit(dir string, nameformat string, backend string, service string, key []byte, keys KeyProvider) (*AuditReport, error) {
+	if nameformat == "" {
+		nameformat = DefaultNameTemplate
+	}
+	naming, err := parseNameTemplate(nameformat)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := listSegments(OSFS, dir, naming, naming.ownRegexp(backend, service))
+	if err != nil {
+		return nil, err
+	}
+	var mine []segment
+	for _, seg := range segments {
+		if seg.own {
+			mine = append(mine, seg)
+		}
+	}
+	sortByName(mine)
+
+	report := &AuditReport{}
+	var chain []byte
+	var prev string
+	for i, seg := range mine {
+		report.Segments++
+		if b := verifySegment(seg.path, key, keys, i == 0, i == len(mine)-1, &chain, &prev, report); b != nil {
+			report.Break = b
+			return report, nil
+		}
+	}
+	return report, nil
+}
+
+//verifySegment 校验一个文件，chain、prev为上一个文件最后一行的hmac和文件名，last为最新的文件
+func verifySegment(fpath string, key []byte, keys KeyProvider, first bool, last bool, chain *[]byte, prev *string, report *AuditReport) *AuditBreak {
+	r, err := openSegment(OSFS, fpath, keys)
+	if err != nil {
+		return &AuditBreak{Path: fpath, Reason: err.Error()}
+	}
+	defer r.Close()
+	br := bufio.NewReader(r)
+	name := segmentBase(fpath)
+	//上一行的原始内容和之前的链，用于校验不完整行的标记；上一行未通过校验时只能紧跟标记
+	var lastline, lastchain []byte
+	var torn *AuditBreak
+	footer := false
+	for lineno := 1; ; lineno++ {
+		line, err := br.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			if err != io.EOF {
+				return &AuditBreak{Path: fpath, Line: lineno, Reason: err.Error()}
+			}
+			break
+		}
+		if err != nil {
+			return &AuditBreak{Path: fpath, Line: lineno, Reason: "incomplete line"}
+		}
+		line = bytes.TrimSuffix(line, []byte{'\n'})
+		if footer {
+			return &AuditBreak{Path: fpath, Line: lineno, Reason: "lines after segment footer"}
+		}
+		if torn != nil && !bytes.HasPrefix(line, []byte(tornPrefix)) {
+			return torn
+		}
+		switch {
+		case lineno == 1:
+			if !bytes.HasPrefix(line, []byte(headerPrefix)) {
+				return &AuditBreak{Path: fpath, Line: lineno, Reason: "missing segment header"}
+			}
+			sum, ok := headerChain(string(line))
+			if !ok {
+				return &AuditBreak{Path: fpath, Line: lineno, Reason: "missing chain in segment header"}
+			}
+			if !first {
+				if p := headerField(string(line), "prev"); p != *prev {
+					return &AuditBreak{Path: fpath, Line: lineno, Reason: fmt.Sprintf("previous segment %s is missing", p)}
+				}
+				if !hmac.Equal(sum, *chain) {
+					return &AuditBreak{Path: fpath, Line: lineno, Reason: fmt.Sprintf("chain broken: lines missing at the end of %s", *prev)}
+				}
+			}
+			*chain = sum
+		case bytes.HasPrefix(line, []byte(footerPrefix)):
+			//切分时写入旧文件末尾，最新的文件不会有footer
+			if last {
+				return &AuditBreak{Path: fpath, Line: lineno, Reason: "footer in the newest segment"}
+			}
+			content, sum, ok := splitAudit(line)
+			if !ok || !hmac.Equal(chainSum(key, *chain, content), sum) {
+				return &AuditBreak{Path: fpath, Line: lineno, Reason: "footer hmac mismatch"}
+			}
+			footer = true
+		case bytes.HasPrefix(line, []byte(tornPrefix)):
+			//进程被杀时写入一半的行，重启时追加标记，标记的hmac串联该行，链从标记继续
+			content, sum, ok := splitAudit(line)
+			if lastline == nil || !ok || headerField(string(content), "bytes") != strconv.Itoa(len(lastline)) ||
+				!hmac.Equal(tornSum(key, lastchain, lastline, content), sum) {
+				return &AuditBreak{Path: fpath, Line: lineno, Reason: "torn line marker mismatch"}
+			}
+			*chain = sum
+			lastline, torn = nil, nil
+		default:
+			lastline, lastchain = line, *chain
+			content, sum, ok := splitAudit(line)
+			if !ok {
+				torn = &AuditBreak{Path: fpath, Line: lineno, Reason: "missing hmac"}
+				continue
+			}
+			if !hmac.Equal(chainSum(key, *chain, content), sum) {
+				torn = &AuditBreak{Path: fpath, Line: lineno, Reason: "hmac mismatch: line modified, or a previous line is missing"}
+				continue
+			}
+			*chain = sum
+			report.Lines++
+		}
+	}
+	if torn != nil {
+		return torn
+	}
+	*prev = name
+	return nil
+}
+
+//segmentBase 去掉压缩后缀的文件名
+func segmentBase(fpath string) string {
+	name := filepath.Base(fpath)
+	for _, ext := range compressExt {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testAuditKey = []byte("audit-key")
+
+//newAuditLogFile 写入dir的审计日志，按小时切分
+func newAuditLogFile(dir string, clock Clock) *LogFile {
+	logfile := NewLogFile()
+	logfile.SetClock(clock)
+	logfile.SetCurDate(clock.Now().Format(defaultDateFormat))
+	logfile.SetFilePath(dir)
+	logfile.SetBackendName("rpc")
+	logfile.SetServiceName("svc.audit")
+	logfile.SetRotateInterval(60)
+	logfile.SetHeaderFooter(true, "")
+	logfile.SetAudit(testAuditKey)
+	logfile.SetSyncPolicy(SyncNever, 0)
+	return logfile
+}
+
+//writeAuditHours 连续hours个小时每小时写入两条日志，返回按序号排列的文件
+func writeAuditHours(t *testing.T, hours int) (string, []string) {
+	t.Helper()
+	dir := t.TempDir()
+	clock := NewFakeClock(time.Date(2024, 1, 2, 10, 0, 0, 0, time.Local))
+	logfile := newAuditLogFile(dir, clock)
+	for i := 0; i < hours; i++ {
+		if i > 0 {
+			clock.Advance(time.Hour)
+		}
+		logfile.Write([]byte(fmt.Sprintf("[LOGINF] tx %d a\n", i)))
+		logfile.Write([]byte(fmt.Sprintf("[LOGINF] tx %d b\n", i)))
+	}
+	if err := logfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "rpc.svc.audit.*"))
+	if len(files) != hours {
+		t.Fatalf("segments %v", files)
+	}
+	return dir, files
+}
+
+func editFile(t *testing.T, fpath string, edit func(string) string) {
+	t.Helper()
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fpath, []byte(edit(string(data))), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func verifyTestAudit(t *testing.T, dir string) *AuditReport {
+	t.Helper()
+	report, err := VerifyAudit(dir, "", "rpc", "svc.audit", testAuditKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestAuditRoundTrip(t *testing.T) {
+	dir, _ := writeAuditHours(t, 3)
+	report := verifyTestAudit(t, dir)
+	if report.Break != nil {
+		t.Fatal(report.Break)
+	}
+	if report.Segments != 3 || report.Lines != 6 {
+		t.Fatalf("segments %d lines %d", report.Segments, report.Lines)
+	}
+
+	//密钥不同时第一行即校验失败
+	report, err := VerifyAudit(dir, "", "rpc", "svc.audit", []byte("other"), nil)
+	if err != nil || report.Break == nil || report.Break.Line != 2 {
+		t.Fatalf("verify with wrong key: %v %+v", err, report.Break)
+	}
+}
+
+func TestAuditTamper(t *testing.T) {
+	cases := []struct {
+		name   string
+		tamper func(files []string)
+		file   int
+		reason string
+	}{
+		{"edit line", func(files []string) {
+			editFile(t, files[1], func(s string) string { return strings.Replace(s, "tx 1 a", "tx 9 a", 1) })
+		}, 1, "hmac mismatch"},
+		{"drop line", func(files []string) {
+			editFile(t, files[1], func(s string) string {
+				lines := strings.SplitAfter(s, "\n")
+				return lines[0] + strings.Join(lines[2:], "")
+			})
+		}, 1, "hmac mismatch"},
+		{"drop middle segment", func(files []string) {
+			os.Remove(files[1])
+		}, 2, "previous segment"},
+		{"edit footer", func(files []string) {
+			editFile(t, files[0], func(s string) string { return strings.Replace(s, "entries=2", "entries=3", 1) })
+		}, 0, "footer hmac mismatch"},
+		{"append after footer", func(files []string) {
+			editFile(t, files[0], func(s string) string { return s + "[LOGINF] forged\n" })
+		}, 0, "lines after segment footer"},
+		{"append without hmac", func(files []string) {
+			editFile(t, files[2], func(s string) string { return s + "[LOGINF] forged\n[LOGINF] more\n" })
+		}, 2, "missing hmac"},
+		{"forge torn marker", func(files []string) {
+			editFile(t, files[2], func(s string) string { return s + "[LOGINF] forged\n" + tornPrefix + "bytes=15\n" })
+		}, 2, "torn line marker mismatch"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, files := writeAuditHours(t, 3)
+			c.tamper(files)
+			report := verifyTestAudit(t, dir)
+			if report.Break == nil || report.Break.Path != files[c.file] || !strings.Contains(report.Break.Reason, c.reason) {
+				t.Fatalf("break %+v, want %q in %s", report.Break, c.reason, files[c.file])
+			}
+		})
+	}
+}
+
+func TestAuditTornLine(t *testing.T) {
+	dir := t.TempDir()
+	clock := NewFakeClock(time.Date(2024, 1, 2, 10, 0, 0, 0, time.Local))
+	logfile := newAuditLogFile(dir, clock)
+	logfile.Write([]byte("[LOGINF] one\n"))
+	logfile.Write([]byte("[LOGINF] two\n"))
+	logfile.Close()
+
+	//模拟写入一半时进程被杀：去掉最后一行的换行和部分hmac
+	files, _ := filepath.Glob(filepath.Join(dir, "rpc.svc.audit.*"))
+	editFile(t, files[0], func(s string) string { return s[:len(s)-10] })
+	logfile = newAuditLogFile(dir, clock)
+	logfile.Write([]byte("[LOGINF] three\n"))
+	logfile.Close()
+
+	data, _ := ioutil.ReadFile(files[0])
+	if !strings.Contains(string(data), "\n"+tornPrefix) {
+		t.Fatalf("no torn marker:\n%s", data)
+	}
+	report := verifyTestAudit(t, dir)
+	if report.Break != nil {
+		t.Fatalf("%v\n%s", report.Break, data)
+	}
+	if report.Lines != 2 {
+		t.Fatalf("lines %d", report.Lines)
+	}
+
+	//修改不完整的行后标记的hmac不再匹配
+	editFile(t, files[0], func(s string) string { return strings.Replace(s, "[LOGINF] two", "[LOGINF] tw0", 1) })
+	if report := verifyTestAudit(t, dir); report.Break == nil || !strings.Contains(report.Break.Reason, "torn line marker mismatch") {
+		t.Fatalf("break %+v", report.Break)
+	}
+}
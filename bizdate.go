@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+//DateProvider 会计日期提供者，返回t所属的会计日期及该会计日的起止时间
+type DateProvider interface {
+	BusinessDay(t time.Time) (date time.Time, start time.Time, end time.Time)
+}
+
+//CutoverDate 按日切时间计算会计日期
+//Cutover不超过12小时(如02:00)时，当日会计日从02:00开始，次日02:00前仍属当日；
+//Cutover超过12小时(如23:00)时，23:00之后即属于下一会计日
+type CutoverDate struct {
+	lock     sync.Mutex
+	cutover  time.Duration
+	location *time.Location
+	override time.Time //手工指定的会计日期，节假日处理使用
+}
+
+//NewCutoverDate cutover格式HH:MM，为空按自然日；location为nil时使用本地时区
+func NewCutoverDate(cutover string, location *time.Location) (*CutoverDate, error) {
+	if location == nil {
+		location = time.Local
+	}
+	provider := &CutoverDate{location: location}
+	if cutover != "" {
+		t, err := time.Parse("15:04", cutover)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cutover time %s: %s", cutover, err)
+		}
+		provider.cutover = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return provider, nil
+}
+
+//shift 会计日起点相对自然日零点的偏移
+func (provider *CutoverDate) shift() time.Duration {
+	if provider.cutover > 12*time.Hour {
+		return provider.cutover - 24*time.Hour
+	}
+	return provider.cutover
+}
+
+func (provider *CutoverDate) BusinessDay(t time.Time) (date time.Time, start time.Time, end time.Time) {
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+	t = t.In(provider.location)
+	shifted := t.Add(-provider.shift())
+	date = time.Date(shifted.Year(), shifted.Month(), shifted.Day(), 0, 0, 0, 0, provider.location)
+	start = date.Add(provider.shift())
+	end = date.AddDate(0, 0, 1).Add(provider.shift())
+	if !provider.override.IsZero() {
+		date = provider.override
+	}
+	return date, start, end
+}
+
+//SetOverride 手工指定会计日期(YYYYMMDD)，为空恢复按日切时间计算
+//所有LogFile在下一次写入时切换到新的会计日期
+func (provider *CutoverDate) SetOverride(date string) error {
+	var override time.Time
+	if date != "" {
+		t, err := time.ParseInLocation(defaultDateFormat, date, provider.location)
+		if err != nil {
+			return fmt.Errorf("invalid override date %s: %s", date, err)
+		}
+		override = t
+	}
+	provider.lock.Lock()
+	provider.override = override
+	provider.lock.Unlock()
+
+	logfiles.Lock()
+	defer logfiles.Unlock()
+	for logfile := range logfiles.m {
+		logfile.lock.Lock()
+		if logfile.dateprovider == DateProvider(provider) {
+			logfile.windowend = time.Time{}
+		}
+		logfile.lock.Unlock()
+	}
+	return nil
+}
+
+//SetDateProvider 设置会计日期提供者，日志文件名中的日期按会计日期切换
+func (logfile *LogFile) SetDateProvider(provider DateProvider) {
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	logfile.dateprovider = provider
+	logfile.windowend = time.Time{}
+}
+
+//businessDay 未设置会计日期提供者时按自然日
+func businessDay(provider DateProvider, t time.Time) (date time.Time, start time.Time, end time.Time) {
+	if provider != nil {
+		return provider.BusinessDay(t)
+	}
+	date = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return date, date, date.AddDate(0, 0, 1)
+}
+
+//InitLog创建的会计日期提供者
+var bizdate *CutoverDate
+
+//SetDateOverride 手工指定InitLog配置的会计日期(YYYYMMDD)，为空恢复自动计算
+func SetDateOverride(date string) error {
+	if bizdate == nil {
+		return fmt.Errorf("business date cutover is not configured")
+	}
+	return bizdate.SetOverride(date)
+}
+
+//解析配置文件中cutover和timezone
+func dateProviderforCfg(cutover string, zone string) (*CutoverDate, error) {
+	if strings.TrimSpace(cutover) == "" && strings.TrimSpace(zone) == "" {
+		return nil, nil
+	}
+	var location *time.Location
+	if zone != "" {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, err
+		}
+		location = loc
+	}
+	return NewCutoverDate(strings.TrimSpace(cutover), location)
+}
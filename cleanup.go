@@ -0,0 +1,266 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+//已打开的LogFile，清理时跳过所有正在写入的文件
+var logfiles = struct {
+	sync.Mutex
+	m map[*LogFile]struct{}
+}{m: make(map[*LogFile]struct{})}
+
+func registerLogFile(logfile *LogFile) {
+	logfiles.Lock()
+	defer logfiles.Unlock()
+	logfiles.m[logfile] = struct{}{}
+}
+func unregisterLogFile(logfile *LogFile) {
+	logfiles.Lock()
+	defer logfiles.Unlock()
+	delete(logfiles.m, logfile)
+}
+
+//activeSegment 判断文件是否为某个LogFile当前正在写入或等待压缩的文件
+func activeSegment(fpath string) bool {
+	logfiles.Lock()
+	defer logfiles.Unlock()
+	for logfile := range logfiles.m {
+		if logfile.inUse(fpath) {
+			return true
+		}
+	}
+	return false
+}
+
+//CleanPolicy 日志文件保留策略，各项为0表示不限制
+type CleanPolicy struct {
+	MaxAge      time.Duration //文件最后修改时间超过MaxAge清理
+	MaxCount    int           //每个服务保留的文件个数
+	MaxBytes    int64         //日志目录下所有日志文件总大小，超过时只清理本服务的文件
+	ArchivePath string        //非空时移动到归档目录，否则删除
+}
+
+func (policy CleanPolicy) enabled() bool {
+	return policy.MaxAge > 0 || policy.MaxCount > 0 || policy.MaxBytes > 0
+}
+
+type segment struct {
+	path    string
+	own     bool //是否为当前服务的日志文件
+	name    segmentName
+	size    int64
+	modtime time.Time
+}
+
+type cleaner struct {
+	logfile  *LogFile
+	policy   CleanPolicy
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+//SetCleanPolicy 设置日志保留策略并启动后台清理协程，interval为清理周期
+func (logfile *LogFile) SetCleanPolicy(policy CleanPolicy, interval time.Duration) {
+	logfile.lock.Lock()
+	old := logfile.cleaner
+	logfile.cleaner = nil
+	if policy.enabled() {
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		logfile.cleaner = &cleaner{
+			logfile:  logfile,
+			policy:   policy,
+			interval: interval,
+			stop:     make(chan struct{}),
+			done:     make(chan struct{}),
+		}
+		go logfile.cleaner.run()
+	}
+	logfile.lock.Unlock()
+	if old != nil {
+		old.close()
+	}
+}
+
+func (c *cleaner) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.clean()
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *cleaner) close() {
+	close(c.stop)
+	<-c.done
+}
+
+//clean 扫描日志目录，按保留时间、文件个数、目录大小依次清理
+func (c *cleaner) clean() {
+	c.logfile.lock.Lock()
+	dir := c.logfile.filepath
+	naming := c.logfile.naming
+	now := c.logfile.clock.Now()
+	fs := c.logfile.fs
+	own := naming.ownRegexp(c.logfile.backendname, c.logfile.servicename)
+	c.logfile.lock.Unlock()
+
+	segments, err := listSegments(fs, dir, naming, own)
+	if err != nil {
+		stdlog.Println("clean log dir error: ", err)
+		return
+	}
+	//按修改时间从旧到新排序
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].modtime.Equal(segments[j].modtime) {
+			return segments[i].path < segments[j].path
+		}
+		return segments[i].modtime.Before(segments[j].modtime)
+	})
+
+	removed := make(map[string]bool)
+	if c.policy.MaxAge > 0 {
+		deadline := now.Add(-c.policy.MaxAge)
+		for _, seg := range segments {
+			if seg.own && seg.modtime.Before(deadline) {
+				c.remove(fs, seg, removed)
+			}
+		}
+	}
+	if c.policy.MaxCount > 0 {
+		var own []segment
+		for _, seg := range segments {
+			if seg.own && !removed[seg.path] {
+				own = append(own, seg)
+			}
+		}
+		sortByName(own)
+		for i := 0; i < len(own)-c.policy.MaxCount; i++ {
+			c.remove(fs, own[i], removed)
+		}
+	}
+	if c.policy.MaxBytes > 0 {
+		var total int64
+		for _, seg := range segments {
+			if !removed[seg.path] {
+				total += seg.size
+			}
+		}
+		//只清理当前服务的文件，其他服务(含审计日志)的文件计入总大小但不删除；
+		//其他进程正在写入的文件不在本进程的LogFile中，每组日志文件的最新一个不清理
+		newest := newestSegments(segments)
+		for _, seg := range segments {
+			if total <= c.policy.MaxBytes {
+				break
+			}
+			if seg.own && !removed[seg.path] && !newest[seg.path] && c.remove(fs, seg, removed) {
+				total -= seg.size
+			}
+		}
+	}
+}
+
+//newestSegments 每组日志文件(同backend、service、host、pid)中日期、时间窗口、序号最大的文件
+func newestSegments(segments []segment) map[string]bool {
+	sorted := append([]segment(nil), segments...)
+	sortByName(sorted)
+	last := make(map[string]string)
+	for _, seg := range sorted {
+		last[seg.name.family] = seg.path
+	}
+	newest := make(map[string]bool, len(last))
+	for _, fpath := range last {
+		newest[fpath] = true
+	}
+	return newest
+}
+
+//sortByName 按文件名中的日期、时间窗口、序号排序
+func sortByName(segments []segment) {
+	sort.SliceStable(segments, func(i, j int) bool {
+		a, b := segments[i].name, segments[j].name
+		if a.date != b.date {
+			return a.date < b.date
+		}
+		if a.time != b.time {
+			return a.time < b.time
+		}
+		return a.index < b.index
+	})
+}
+
+//remove 删除或归档文件，当前正在写入的文件不处理
+func (c *cleaner) remove(fs FileSystem, seg segment, removed map[string]bool) bool {
+	if activeSegment(seg.path) {
+		return false
+	}
+	var err error
+	if c.policy.ArchivePath != "" {
+		if err = fs.MkdirAll(c.policy.ArchivePath, 0755); err == nil {
+			err = fs.Rename(seg.path, filepath.Join(c.policy.ArchivePath, filepath.Base(seg.path)))
+		}
+	} else {
+		err = fs.Remove(seg.path)
+	}
+	if err != nil {
+		stdlog.Println("clean log file error: ", err)
+		return false
+	}
+	removed[seg.path] = true
+	//按日期分目录时删除空目录
+	if dir := filepath.Dir(seg.path); dir != c.logfile.filepath {
+		fs.Remove(dir)
+	}
+	return true
+}
+
+//listSegments 列出目录(含子目录)下所有符合命名模板的日志文件
+func listSegments(fs FileSystem, dir string, naming *nameTemplate, own *regexp.Regexp) ([]segment, error) {
+	all := naming.pattern(nil)
+	var segments []segment
+	var walk func(sub string, depth int) error
+	walk = func(sub string, depth int) error {
+		infos, err := fs.ReadDir(filepath.Join(dir, filepath.FromSlash(sub)))
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			rel := path.Join(sub, info.Name())
+			if info.IsDir() {
+				//只遍历命名模板中的目录层级，子目录读取失败时忽略
+				if depth+1 < len(naming.parts) {
+					walk(rel, depth+1)
+				}
+				continue
+			}
+			name, ok := parseSegmentName(all, rel)
+			if !ok {
+				continue
+			}
+			segments = append(segments, segment{
+				path:    filepath.Join(dir, filepath.FromSlash(rel)),
+				own:     own.MatchString(rel),
+				name:    name,
+				size:    info.Size(),
+				modtime: info.ModTime(),
+			})
+		}
+		return nil
+	}
+	err := walk("", 0)
+	return segments, err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+//writeDays 连续days天每天写入一条日志，按天切分为days个文件
+func writeDays(logfile *LogFile, clock *FakeClock, days int) {
+	for i := 0; i < days; i++ {
+		if i > 0 {
+			clock.Advance(24 * time.Hour)
+		}
+		logfile.Write([]byte(fmt.Sprintf("[LOGINF] day %d\n", i)))
+	}
+}
+
+//cleanOnce 启动清理协程后立即停止，清理协程启动时执行一次清理
+func cleanOnce(logfile *LogFile, policy CleanPolicy) {
+	logfile.SetCleanPolicy(policy, time.Hour)
+	logfile.SetCleanPolicy(CleanPolicy{}, 0)
+}
+
+func TestRetentionMaxCount(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local))
+	fs := NewMemFS(clock)
+	logfile := newTestLogFile(fs, clock)
+	defer logfile.Close()
+	writeDays(logfile, clock, 5)
+
+	cleanOnce(logfile, CleanPolicy{MaxCount: 3})
+	names, _ := readSegments(t, fs, "/logs")
+	want := []string{"rpc.svc.20240103.000000", "rpc.svc.20240104.000000", "rpc.svc.20240105.000000"}
+	if fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Fatalf("segments %v, want %v", names, want)
+	}
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local))
+	fs := NewMemFS(clock)
+	logfile := newTestLogFile(fs, clock)
+	defer logfile.Close()
+	writeDays(logfile, clock, 5)
+	clock.Advance(time.Hour)
+
+	cleanOnce(logfile, CleanPolicy{MaxAge: 48 * time.Hour})
+	names, _ := readSegments(t, fs, "/logs")
+	want := []string{"rpc.svc.20240104.000000", "rpc.svc.20240105.000000"}
+	if fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Fatalf("segments %v, want %v", names, want)
+	}
+}
+
+func TestRetentionKeepsActiveSegment(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local))
+	fs := NewMemFS(clock)
+	logfile := newTestLogFile(fs, clock)
+	defer logfile.Close()
+	writeDays(logfile, clock, 3)
+	clock.Advance(30 * 24 * time.Hour)
+
+	//当前正在写入的文件即使超过保留时间也不清理
+	cleanOnce(logfile, CleanPolicy{MaxAge: 24 * time.Hour, ArchivePath: "/archive"})
+	names, _ := readSegments(t, fs, "/logs")
+	if want := []string{"rpc.svc.20240103.000000"}; fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Fatalf("segments %v, want %v", names, want)
+	}
+	archived, _ := readSegments(t, fs, "/archive")
+	if want := []string{"rpc.svc.20240101.000000", "rpc.svc.20240102.000000"}; fmt.Sprint(archived) != fmt.Sprint(want) {
+		t.Fatalf("archived %v, want %v", archived, want)
+	}
+}
+
+func TestRetentionMaxBytesKeepsOtherFamilies(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local))
+	fs := NewMemFS(clock)
+	logfile := newTestLogFile(fs, clock)
+	defer logfile.Close()
+	audit := newTestLogFile(fs, clock)
+	audit.SetServiceName("svc.audit")
+	defer audit.Close()
+	for i := 0; i < 4; i++ {
+		if i > 0 {
+			clock.Advance(24 * time.Hour)
+		}
+		logfile.Write([]byte(fmt.Sprintf("[LOGINF] day %d\n", i)))
+		audit.Write([]byte(fmt.Sprintf("[LOGINF] audit %d\n", i)))
+	}
+
+	//审计日志属于其他服务，即使目录总大小超限也不删除
+	cleanOnce(logfile, CleanPolicy{MaxBytes: 1})
+	names, _ := readSegments(t, fs, "/logs")
+	want := []string{
+		"rpc.svc.20240104.000000",
+		"rpc.svc.audit.20240101.000000",
+		"rpc.svc.audit.20240102.000000",
+		"rpc.svc.audit.20240103.000000",
+		"rpc.svc.audit.20240104.000000",
+	}
+	if fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Fatalf("segments %v, want %v", names, want)
+	}
+}
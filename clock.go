@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+//Clock 时间来源，日志切分、文件命名、时间戳输出都通过Clock获取当前时间
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+//SystemClock 系统时间
+var SystemClock Clock = systemClock{}
+
+//FakeClock 测试用的时钟，只有调用Set/Advance时才会变化
+type FakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.now
+}
+
+func (clock *FakeClock) Set(now time.Time) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	clock.now = now
+}
+
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+//SetClock 设置LogFile使用的时钟，为nil时使用系统时间
+func (logfile *LogFile) SetClock(clock Clock) {
+	if clock == nil {
+		clock = SystemClock
+	}
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	logfile.clock = clock
+	logfile.windowend = time.Time{}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+//runCommand 运维命令，args为命令行参数，不是已知命令时返回false
+//  verify -dir 日志目录 -backend rpc -service service01.audit -key 密钥文件 [-nameformat 命名模板] [-enckey 加密密钥文件]
+//  decrypt -key 密钥文件1,密钥文件2 日志文件...
+//  checkcrc [-key 加密密钥文件] 日志文件...
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "verify":
+		os.Exit(verifyCommand(args[1:]))
+	case "decrypt":
+		os.Exit(decryptCommand(args[1:]))
+	case "checkcrc":
+		os.Exit(checkcrcCommand(args[1:]))
+	}
+	return false
+}
+
+//verifyCommand 校验审计日志的hmac链，通过返回0，发现断链返回1，参数错误返回2
+func verifyCommand(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	dir := flags.String("dir", ".", "log directory")
+	backend := flags.String("backend", "", "backend name")
+	service := flags.String("service", "", "service name, e.g. service01.audit")
+	keyfile := flags.String("key", "", "HMAC key file")
+	nameformat := flags.String("nameformat", "", "log file name template")
+	enckey := flags.String("enckey", "", "comma separated encryption key files for encrypted segments")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *backend == "" || *service == "" || *keyfile == "" {
+		fmt.Fprintln(os.Stderr, "verify: -backend, -service and -key are required")
+		return 2
+	}
+	key, err := LoadKeyFile(*keyfile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "verify:", err)
+		return 2
+	}
+	keys, err := encryptKeysforCfg(*enckey)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "verify:", err)
+		return 2
+	}
+	report, err := VerifyAudit(*dir, *nameformat, *backend, *service, key, keys)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "verify:", err)
+		return 2
+	}
+	if report.Break != nil {
+		fmt.Printf("BROKEN %s (%d segments, %d lines verified before)\n", report.Break, report.Segments, report.Lines)
+		return 1
+	}
+	fmt.Printf("OK %d segments, %d lines\n", report.Segments, report.Lines)
+	return 0
+}
+
+//decryptCommand 解密日志文件(含压缩文件)输出到标准输出，可配合grep使用；文件为"-"时读取标准输入
+func decryptCommand(args []string) int {
+	flags := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+	keyfiles := flags.String("key", "", "comma separated encryption key files")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	keys, err := encryptKeysforCfg(*keyfiles)
+	if err != nil || keys == nil || flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "decrypt: -key and at least one file are required", err)
+		return 2
+	}
+	code := 0
+	for _, fpath := range flags.Args() {
+		var r io.ReadCloser
+		if fpath == "-" {
+			r = io.NopCloser(NewDecryptReader(os.Stdin, keys))
+		} else if r, err = openSegment(OSFS, fpath, keys); err != nil {
+			fmt.Fprintln(os.Stderr, "decrypt:", err)
+			code = 1
+			continue
+		}
+		if _, err := io.Copy(os.Stdout, r); err != nil {
+			fmt.Fprintf(os.Stderr, "decrypt: %s: %s\n", fpath, err)
+			code = 1
+		}
+		r.Close()
+	}
+	return code
+}
+
+//checkcrcCommand 校验日志文件(含压缩、加密文件)每条日志的crc列，输出未通过的行，全部通过返回0，有失败返回1，参数错误返回2
+func checkcrcCommand(args []string) int {
+	flags := flag.NewFlagSet("checkcrc", flag.ContinueOnError)
+	keyfiles := flags.String("key", "", "comma separated encryption key files for encrypted segments")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	keys, err := encryptKeysforCfg(*keyfiles)
+	if err != nil || flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "checkcrc: at least one file is required", err)
+		return 2
+	}
+	code := 0
+	for _, fpath := range flags.Args() {
+		var r io.ReadCloser
+		if fpath == "-" {
+			r = io.NopCloser(os.Stdin)
+		} else if r, err = openSegment(OSFS, fpath, keys); err != nil {
+			fmt.Fprintln(os.Stderr, "checkcrc:", err)
+			code = 1
+			continue
+		}
+		report, err := ValidateCRC(r)
+		r.Close()
+		for _, failed := range report.Failed {
+			fmt.Printf("%s:%d: %s: %s\n", fpath, failed.Line, failed.Reason, failed.Text)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "checkcrc: %s: %s\n", fpath, err)
+			code = 1
+		}
+		if len(report.Failed) > 0 {
+			code = 1
+		}
+		fmt.Printf("%s: %d lines, %d checked, %d failed\n", fpath, report.Lines, report.Checked, len(report.Failed))
+	}
+	return code
+}
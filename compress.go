@@ -0,0 +1,235 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+)
+
+//压缩文件后缀
+var compressExt = map[string]string{
+	CompressGzip: ".gz",
+	CompressZstd: ".zst",
+}
+
+//compressor 后台压缩已关闭的日志文件
+type compressor struct {
+	format  string
+	fs      FileSystem
+	lock    sync.Mutex
+	cond    *sync.Cond
+	queue   []string
+	pending map[string]bool
+	closed  bool
+	done    chan struct{}
+}
+
+//SetCompress 设置已切分日志文件的压缩格式(gzip、zstd)，为空不压缩
+func (logfile *LogFile) SetCompress(format string) {
+	format = strings.ToLower(format)
+	if _, ok := compressExt[format]; format != "" && !ok {
+		stdlog.Println("unsupported compress format: ", format)
+		format = ""
+	}
+	logfile.lock.Lock()
+	old := logfile.zipper
+	logfile.zipper = nil
+	if format != "" {
+		zipper := &compressor{
+			format:  format,
+			fs:      logfile.fs,
+			pending: make(map[string]bool),
+			done:    make(chan struct{}),
+		}
+		zipper.cond = sync.NewCond(&zipper.lock)
+		logfile.zipper = zipper
+		go zipper.run()
+	}
+	logfile.lock.Unlock()
+	if old != nil {
+		old.close()
+	}
+}
+
+//compress 将已关闭的日志文件加入压缩队列，降级输出的文件不在日志目录下，由调用方排除，调用前需持有lock
+func (logfile *LogFile) compress(fpath string) {
+	if logfile.zipper == nil {
+		return
+	}
+	zipper := logfile.zipper
+	zipper.lock.Lock()
+	if zipper.closed || zipper.pending[fpath] {
+		zipper.lock.Unlock()
+		return
+	}
+	zipper.pending[fpath] = true
+	zipper.lock.Unlock()
+	//等OnRotate等回调返回后再压缩，回调中旧文件仍可读取
+	logfile.after(func() {
+		zipper.enqueue(fpath)
+	})
+}
+
+//enqueue 加入压缩队列，已关闭时放弃压缩
+func (zipper *compressor) enqueue(fpath string) {
+	zipper.lock.Lock()
+	defer zipper.lock.Unlock()
+	if zipper.closed {
+		delete(zipper.pending, fpath)
+		return
+	}
+	zipper.queue = append(zipper.queue, fpath)
+	zipper.cond.Signal()
+}
+
+func (zipper *compressor) run() {
+	defer close(zipper.done)
+	for {
+		zipper.lock.Lock()
+		for len(zipper.queue) == 0 && !zipper.closed {
+			zipper.cond.Wait()
+		}
+		if len(zipper.queue) == 0 {
+			zipper.lock.Unlock()
+			return
+		}
+		fpath := zipper.queue[0]
+		zipper.queue = zipper.queue[1:]
+		fs := zipper.fs
+		zipper.lock.Unlock()
+
+		if err := compressFile(fs, fpath, zipper.format); err != nil {
+			stdlog.Println("compress log file error: ", err)
+		}
+		zipper.lock.Lock()
+		delete(zipper.pending, fpath)
+		zipper.lock.Unlock()
+	}
+}
+
+//close 处理完队列中剩余文件后退出
+func (zipper *compressor) close() {
+	zipper.lock.Lock()
+	zipper.closed = true
+	zipper.cond.Broadcast()
+	zipper.lock.Unlock()
+	<-zipper.done
+}
+
+func (zipper *compressor) busy(fpath string) bool {
+	zipper.lock.Lock()
+	defer zipper.lock.Unlock()
+	return zipper.pending[fpath]
+}
+
+//compressedExists 判断日志文件是否已被压缩
+func compressedExists(fs FileSystem, fpath string) bool {
+	for _, ext := range compressExt {
+		if _, err := fs.Stat(fpath + ext); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+//compressFile 压缩日志文件，解压校验通过后删除原文件
+func compressFile(fs FileSystem, fpath string, format string) error {
+	src, err := fs.OpenFile(fpath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dstpath := fpath + compressExt[format]
+	tmppath := dstpath + ".tmp"
+	dst, err := fs.OpenFile(tmppath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return err
+	}
+	crc := crc32.NewIEEE()
+	size, err := writeCompressed(dst, io.TeeReader(src, crc), format)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = verifyCompressed(fs, tmppath, format, size, crc.Sum32())
+	}
+	if err != nil {
+		fs.Remove(tmppath)
+		return fmt.Errorf("compress %s error: %s", fpath, err)
+	}
+	if err := fs.Rename(tmppath, dstpath); err != nil {
+		fs.Remove(tmppath)
+		return err
+	}
+	src.Close()
+	return fs.Remove(fpath)
+}
+
+func writeCompressed(dst io.Writer, src io.Reader, format string) (int64, error) {
+	var w io.WriteCloser
+	switch format {
+	case CompressZstd:
+		zw, err := zstd.NewWriter(dst)
+		if err != nil {
+			return 0, err
+		}
+		w = zw
+	default:
+		w = gzip.NewWriter(dst)
+	}
+	size, err := io.Copy(w, src)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return size, err
+}
+
+//verifyCompressed 解压并比较长度和crc32
+func verifyCompressed(fs FileSystem, fpath string, format string, size int64, sum uint32) error {
+	file, err := fs.OpenFile(fpath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r, err := newDecompressReader(file, format)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	crc := crc32.NewIEEE()
+	n, err := io.Copy(crc, r)
+	if err != nil {
+		return err
+	}
+	if n != size || crc.Sum32() != sum {
+		return fmt.Errorf("verify %s failed", fpath)
+	}
+	return nil
+}
+
+func newDecompressReader(r io.Reader, format string) (io.ReadCloser, error) {
+	switch format {
+	case CompressZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return gzip.NewReader(r)
+	}
+}
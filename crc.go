@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+//crcPrefix Formatter开启LineCRC时的行首列：[crc = 8位十六进制]
+const crcPrefix = "[" + FieldKeyCRC + " = "
+
+//CRCError 未通过CRC校验的行
+type CRCError struct {
+	Line   int
+	Reason string
+	Text   string
+}
+
+func (e CRCError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Reason)
+}
+
+//CRCReport 校验结果，Lines为日志行数(不含header、footer等元数据行)，Checked为带crc列的日志条数
+type CRCReport struct {
+	Lines   int
+	Checked int
+	Failed  []CRCError
+}
+
+//ValidateCRC 按条校验Formatter输出的crc列，返回校验失败的日志(位翻转、写入不完整等)，Line为日志首行的行号
+//带crc列的日志只在下一个crc列处结束，之间的行都属于该条日志(未转义换行的多行日志)；没有crc列的日志按行首'['划分且不校验
+//header、footer等元数据行跳过，审计日志每行末尾的hmac不参与计算
+func ValidateCRC(r io.Reader) (*CRCReport, error) {
+	report := &CRCReport{}
+	br := bufio.NewReaderSize(r, 64*1024)
+	var entry []byte
+	entryline, complete := 0, true
+	flush := func() {
+		if entryline == 0 {
+			return
+		}
+		reason, checked := checkLineCRC(entry)
+		if checked {
+			report.Checked++
+		}
+		if reason == "" && !complete && checked {
+			reason = "incomplete line"
+		}
+		if reason != "" {
+			report.Failed = append(report.Failed, CRCError{Line: entryline, Reason: reason, Text: string(entry)})
+		}
+		entry, entryline = entry[:0], 0
+	}
+	for lineno := 1; ; lineno++ {
+		line, err := br.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			flush()
+			if err == io.EOF {
+				return report, nil
+			}
+			return report, err
+		}
+		line = bytes.TrimSuffix(line, []byte{'\n'})
+		if isMetaLine(line) {
+			flush()
+			continue
+		}
+		report.Lines++
+		if content, _, ok := splitAudit(line); ok {
+			line = content
+		}
+		if entryline == 0 || bytes.HasPrefix(line, []byte(crcPrefix)) ||
+			(!bytes.HasPrefix(entry, []byte(crcPrefix[:3])) && isEntryStart(line)) {
+			flush()
+			entryline = lineno
+		} else {
+			entry = append(entry, '\n')
+		}
+		entry = append(entry, line...)
+		complete = err == nil
+		if err != nil {
+			flush()
+			if err == io.EOF {
+				return report, nil
+			}
+			return report, err
+		}
+	}
+}
+
+//checkLineCRC 校验一条日志(已去掉hmac)，reason为空表示通过，checked表示带crc列
+func checkLineCRC(line []byte) (reason string, checked bool) {
+	if !bytes.HasPrefix(line, []byte(crcPrefix)) {
+		//行首的crc列本身损坏
+		if bytes.HasPrefix(line, []byte(crcPrefix[:3])) {
+			return "malformed crc column", true
+		}
+		return "", false
+	}
+	rest := line[len(crcPrefix):]
+	end := bytes.IndexByte(rest, ']')
+	if end != 2*crc32.Size {
+		return "malformed crc column", true
+	}
+	want, err := hex.DecodeString(string(rest[:end]))
+	if err != nil {
+		return "malformed crc column", true
+	}
+	sum := crc32.ChecksumIEEE(rest[end+1:])
+	if sum != binary.BigEndian.Uint32(want) {
+		return fmt.Sprintf("crc mismatch: want %x, got %08x", want, sum), true
+	}
+	return "", true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"hash/crc32"
+	"strings"
+	"testing"
+)
+
+//crcLines 使用开启LineCRC的Formatter输出日志
+func crcLines(log func(logger *logrus.Logger)) string {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&Formatter{LineCRC: true})
+	log(logger)
+	return buf.String()
+}
+
+//withCRC 按Formatter的格式在content前加crc列，模拟未转义换行的多行日志
+func withCRC(content string) string {
+	return fmt.Sprintf("%s%08x]%s\n", crcPrefix, crc32.ChecksumIEEE([]byte(content)), content)
+}
+
+func validate(t *testing.T, text string) *CRCReport {
+	t.Helper()
+	report, err := ValidateCRC(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestValidateCRC(t *testing.T) {
+	text := crcLines(func(logger *logrus.Logger) {
+		logger.WithField("k", "v").Info("hello")
+		logger.Info("hello\n[bracket] continuation")
+		logger.Warn("world")
+	})
+	report := validate(t, "#LOGHDR x\n"+text+"#LOGEND entries=3\n")
+	if report.Lines != 3 || report.Checked != 3 || len(report.Failed) != 0 {
+		t.Fatalf("%+v", report)
+	}
+
+	//位翻转
+	report = validate(t, strings.Replace(text, "world", "wocld", 1))
+	if len(report.Failed) != 1 || report.Failed[0].Line != 3 || !strings.Contains(report.Failed[0].Reason, "crc mismatch") {
+		t.Fatalf("%+v", report)
+	}
+	//crc列本身损坏
+	report = validate(t, strings.Replace(text, crcPrefix, "[crc = zz", 1))
+	if len(report.Failed) != 1 || report.Failed[0].Reason != "malformed crc column" {
+		t.Fatalf("%+v", report)
+	}
+	//末尾不完整的行
+	report = validate(t, strings.TrimSuffix(text, "\n"))
+	if len(report.Failed) != 1 || report.Failed[0].Line != 3 || report.Failed[0].Reason != "incomplete line" {
+		t.Fatalf("%+v", report)
+	}
+}
+
+func TestValidateCRCMultilineEntry(t *testing.T) {
+	//带crc列的日志中以'['开头的行不是新的日志
+	text := withCRC("[LOGINF][hello\n[bracket] continuation]") + withCRC("[LOGINF][next]")
+	report := validate(t, text)
+	if report.Lines != 3 || report.Checked != 2 || len(report.Failed) != 0 {
+		t.Fatalf("%+v", report)
+	}
+	report = validate(t, strings.Replace(text, "[bracket]", "[brackex]", 1))
+	if len(report.Failed) != 1 || report.Failed[0].Line != 1 || report.Checked != 2 {
+		t.Fatalf("%+v", report)
+	}
+}
+
+func TestValidateCRCAudit(t *testing.T) {
+	logfile := NewLogFile()
+	defer logfile.Close()
+	logfile.auditkey = []byte("key")
+	text := crcLines(func(logger *logrus.Logger) {
+		logger.Info("one")
+		logger.Info("two")
+	})
+	chained, _ := logfile.chainLines(nil, []byte(text))
+	report := validate(t, string(chained))
+	if report.Checked != 2 || len(report.Failed) != 0 {
+		t.Fatalf("%+v", report)
+	}
+	report = validate(t, strings.Replace(string(chained), "two", "twx", 1))
+	if len(report.Failed) != 1 || report.Failed[0].Line != 2 {
+		t.Fatalf("%+v", report)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+//加密文件格式：首行明文 #LOGENC version=2 cipher=aes-gcm key=密钥ID segment=文件名，之后每次写入为一帧：
+//4字节帧长度(大端) + 12字节nonce + 密文及16字节tag，帧之间相互独立，追加写入和崩溃后恢复不受影响
+//密钥ID、文件名和帧序号作为附加数据参与认证，帧被删除、调换顺序或拼接到其他文件时解密失败
+//version=1的文件没有附加数据，仍可解密
+const (
+	encryptPrefix = "#LOGENC "
+	frameLenSize  = 4
+	nonceSize     = 12
+	tagSize       = 16
+	frameOverhead = frameLenSize + nonceSize + tagSize
+	maxFrameSize  = 16 << 20 //单帧最大明文长度，超过时拆分为多帧
+)
+
+//ErrTruncatedFrame 文件末尾的帧不完整，通常是写入时进程崩溃
+var ErrTruncatedFrame = errors.New("truncated encrypted frame")
+
+//KeyProvider 加密密钥提供者，新文件使用CurrentKey加密，解密时按文件首行的密钥ID查找
+type KeyProvider interface {
+	CurrentKey() (id string, key []byte, err error)
+	Key(id string) ([]byte, error)
+}
+
+//StaticKeys 固定的密钥集合，第一个添加的密钥为当前密钥
+type StaticKeys struct {
+	lock    sync.Mutex
+	current string
+	keys    map[string][]byte
+}
+
+func NewStaticKeys() *StaticKeys {
+	return &StaticKeys{keys: make(map[string][]byte)}
+}
+
+//Add 添加密钥，key为16、24、32字节的AES密钥
+func (k *StaticKeys) Add(id string, key []byte) error {
+	if id == "" || strings.ContainsAny(id, " \t\n") {
+		return fmt.Errorf("invalid key id %q", id)
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return fmt.Errorf("key %s: %s", id, err)
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.keys[id] = key
+	if k.current == "" {
+		k.current = id
+	}
+	return nil
+}
+
+//SetCurrent 切换加密使用的密钥，之后新打开的日志文件使用该密钥
+func (k *StaticKeys) SetCurrent(id string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("unknown key id %s", id)
+	}
+	k.current = id
+	return nil
+}
+
+func (k *StaticKeys) CurrentKey() (string, []byte, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.current == "" {
+		return "", nil, errors.New("no encryption key")
+	}
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *StaticKeys) Key(id string) ([]byte, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %s", id)
+	}
+	return key, nil
+}
+
+//LoadKeyFiles 读取密钥文件(十六进制或原始字节)，密钥ID为文件名，第一个文件为当前密钥
+func LoadKeyFiles(paths ...string) (*StaticKeys, error) {
+	keys := NewStaticKeys()
+	for _, fpath := range paths {
+		data, err := LoadKeyFile(fpath)
+		if err != nil {
+			return nil, err
+		}
+		key := data
+		if decoded, err := hex.DecodeString(string(data)); err == nil {
+			key = decoded
+		}
+		if err := keys.Add(filepath.Base(fpath), key); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+//解析配置文件中encryptkey，多个密钥文件用逗号分隔
+func encryptKeysforCfg(files string) (KeyProvider, error) {
+	var paths []string
+	for _, fpath := range strings.Split(files, ",") {
+		if fpath = strings.TrimSpace(fpath); fpath != "" {
+			paths = append(paths, fpath)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	keys, err := LoadKeyFiles(paths...)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+//SetEncryption 开启后新日志文件使用AES-GCM分帧加密，keys为nil关闭
+//当前文件的加密状态或密钥与设置不一致时，下一次写入切换到新文件
+func (logfile *LogFile) SetEncryption(keys KeyProvider) {
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	logfile.keys = keys
+	if logfile.file != nil {
+		logfile.scanSegment(logfile.file)
+	}
+}
+
+//encryptionChanged 已打开的文件与当前加密设置(是否加密、当前密钥)不一致，调用前需持有lock
+func (logfile *LogFile) encryptionChanged(file File) bool {
+	c, ok := file.(*cryptFile)
+	if ok != (logfile.keys != nil) {
+		return true
+	}
+	if !ok {
+		return false
+	}
+	id, _, err := logfile.keys.CurrentKey()
+	return err == nil && id != c.keyid
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//cryptFile 加密写入的文件，每次Write写入一帧
+type cryptFile struct {
+	File
+	keyid   string
+	segment string
+	aead    cipher.AEAD
+	seq     uint64 //下一帧的序号，追加到已有文件时由scanSegment恢复
+}
+
+//frameAAD 帧的附加数据：密钥ID、文件名和帧序号
+func frameAAD(keyid string, segment string, seq uint64) []byte {
+	aad := make([]byte, 0, len(keyid)+len(segment)+10)
+	aad = append(aad, keyid...)
+	aad = append(aad, 0)
+	aad = append(aad, segment...)
+	aad = append(aad, 0)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], seq)
+	return append(aad, buf[:]...)
+}
+
+//encryptFile 使用当前密钥加密写入，空文件先写入首行
+func encryptFile(file File, keys KeyProvider) (File, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	segment := segmentBase(file.Name())
+	if fInfo, err := file.Stat(); err == nil && fInfo.Size() == 0 {
+		if _, err := io.WriteString(file, encryptPrefix+"version=2 cipher=aes-gcm key="+id+" segment="+segment+"\n"); err != nil {
+			return nil, err
+		}
+	}
+	return &cryptFile{File: file, keyid: id, segment: segment, aead: aead}, nil
+}
+
+//Write 一次写入完整的帧，返回明文长度
+func (f *cryptFile) Write(p []byte) (int, error) {
+	frames := make([]byte, 0, len(p)+frameOverhead*(len(p)/maxFrameSize+1))
+	seq := f.seq
+	for rest := p; len(rest) > 0; seq++ {
+		chunk := rest
+		if len(chunk) > maxFrameSize {
+			chunk = chunk[:maxFrameSize]
+		}
+		rest = rest[len(chunk):]
+		start := len(frames)
+		frames = append(frames, make([]byte, frameLenSize+nonceSize)...)
+		nonce := frames[start+frameLenSize : start+frameLenSize+nonceSize]
+		if _, err := rand.Read(nonce); err != nil {
+			return 0, err
+		}
+		frames = f.aead.Seal(frames, nonce, chunk, frameAAD(f.keyid, f.segment, seq))
+		binary.BigEndian.PutUint32(frames[start:], uint32(len(frames)-start-frameLenSize))
+	}
+	if _, err := f.File.Write(frames); err != nil {
+		return 0, err
+	}
+	f.seq = seq
+	return len(p), nil
+}
+
+//overhead 写入n字节明文时加密增加的长度
+func (f *cryptFile) overhead(n int) int64 {
+	if n == 0 {
+		return 0
+	}
+	return int64((n+maxFrameSize-1)/maxFrameSize) * frameOverhead
+}
+
+//encryptedKeyID 预读首行，判断是否为加密文件并返回密钥ID
+func encryptedKeyID(r *bufio.Reader) (string, bool) {
+	head, _ := r.Peek(len(encryptPrefix))
+	if string(head) != encryptPrefix {
+		return "", false
+	}
+	buf, _ := r.Peek(r.Buffered())
+	if idx := bytes.IndexByte(buf, '\n'); idx >= 0 {
+		buf = buf[:idx]
+	}
+	return headerField(string(buf), "key"), true
+}
+
+//decryptReader 解密分帧加密的内容，遇到新的首行时切换密钥并重新计算帧序号(降级到stderr时可能出现多次)
+type decryptReader struct {
+	r       *bufio.Reader
+	keys    KeyProvider
+	name    string //不为空时校验首行中的文件名
+	keyid   string
+	segment string
+	legacy  bool //version=1，没有附加数据
+	aead    cipher.AEAD
+	seq     uint64
+	buf     []byte
+	err     error
+}
+
+//NewDecryptReader 返回解密后的明文，末尾帧不完整时返回ErrTruncatedFrame
+//帧按首行中的文件名校验，需要确认内容属于某个文件时使用openSegment
+func NewDecryptReader(r io.Reader, keys KeyProvider) io.Reader {
+	return newDecryptReader(r, keys, "")
+}
+
+//newDecryptReader name不为空时要求首行中的文件名为name，整个文件被复制为其他文件时解密失败
+func newDecryptReader(r io.Reader, keys KeyProvider, name string) *decryptReader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &decryptReader{r: br, keys: keys, name: name}
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.err = d.next()
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+//next 读取下一帧或首行
+func (d *decryptReader) next() error {
+	head, err := d.r.Peek(1)
+	if err != nil {
+		return err
+	}
+	if head[0] == encryptPrefix[0] {
+		line, err := d.r.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, encryptPrefix) {
+			return errors.New("invalid encryption header")
+		}
+		id := headerField(line, "key")
+		key, err := d.keys.Key(id)
+		if err != nil {
+			return err
+		}
+		if d.aead, err = newAEAD(key); err != nil {
+			return fmt.Errorf("key %s: %s", id, err)
+		}
+		d.keyid, d.segment, d.seq = id, headerField(line, "segment"), 0
+		d.legacy = headerField(line, "version") == "1"
+		if !d.legacy && d.name != "" && d.segment != d.name {
+			return fmt.Errorf("encrypted segment %s doesn't belong to %s", d.segment, d.name)
+		}
+		return nil
+	}
+	if d.aead == nil {
+		return errors.New("missing encryption header")
+	}
+	var size [frameLenSize]byte
+	if _, err := io.ReadFull(d.r, size[:]); err != nil {
+		return ErrTruncatedFrame
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < nonceSize+tagSize || n > maxFrameSize+nonceSize+tagSize {
+		return fmt.Errorf("invalid encrypted frame size %d", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(d.r, frame); err != nil {
+		return ErrTruncatedFrame
+	}
+	var aad []byte
+	if !d.legacy {
+		aad = frameAAD(d.keyid, d.segment, d.seq)
+	}
+	plain, err := d.aead.Open(frame[nonceSize:nonceSize], frame[:nonceSize], frame[nonceSize:], aad)
+	if err != nil {
+		return fmt.Errorf("decrypt frame %d error: %s", d.seq, err)
+	}
+	d.seq++
+	d.buf = plain
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestKeys(t *testing.T, ids ...string) *StaticKeys {
+	t.Helper()
+	keys := NewStaticKeys()
+	for _, id := range ids {
+		if err := keys.Add(id, bytes.Repeat([]byte(id[len(id)-1:]), 32)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keys
+}
+
+//newCryptLogFile 写入MemFS的加密日志
+func newCryptLogFile(fs *MemFS, clock Clock, keys KeyProvider) *LogFile {
+	logfile := newTestLogFile(fs, clock)
+	logfile.SetEncryption(keys)
+	return logfile
+}
+
+//decryptSegment 按文件名解密MemFS中的日志文件
+func decryptSegment(fs *MemFS, fpath string, keys KeyProvider) (string, error) {
+	r, err := openSegment(fs, fpath, keys)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	return string(data), err
+}
+
+func writeMemFile(t *testing.T, fs *MemFS, fpath string, data []byte) {
+	t.Helper()
+	file, err := fs.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//splitFrames 拆分为首行和各帧
+func splitFrames(t *testing.T, data []byte) (header []byte, frames [][]byte) {
+	t.Helper()
+	idx := bytes.IndexByte(data, '\n')
+	if idx < 0 {
+		t.Fatalf("no encryption header: %q", data)
+	}
+	header, data = data[:idx+1], data[idx+1:]
+	for len(data) > 0 {
+		n := frameLenSize + int(binary.BigEndian.Uint32(data))
+		frames = append(frames, data[:n])
+		data = data[n:]
+	}
+	return header, frames
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local))
+	fs := NewMemFS(clock)
+	keys := newTestKeys(t, "k1")
+	logfile := newCryptLogFile(fs, clock, keys)
+	logfile.Write([]byte("[LOGINF] secret 1\n"))
+	logfile.Write([]byte("[LOGINF] secret 2\n"))
+	logfile.Close()
+	//重启后继续追加，帧序号从已有帧数继续
+	logfile = newCryptLogFile(fs, clock, keys)
+	logfile.Write([]byte("[LOGINF] secret 3\n"))
+	logfile.Close()
+
+	names, contents := readSegments(t, fs, "/logs")
+	if len(names) != 1 || bytes.Contains(contents[0], []byte("secret")) {
+		t.Fatalf("segments %v %q", names, contents)
+	}
+	plain, err := decryptSegment(fs, "/logs/"+names[0], keys)
+	if err != nil || plain != "[LOGINF] secret 1\n[LOGINF] secret 2\n[LOGINF] secret 3\n" {
+		t.Fatalf("decrypt %q %v", plain, err)
+	}
+	plain2, err := ioutil.ReadAll(NewDecryptReader(bytes.NewReader(contents[0]), keys))
+	if err != nil || string(plain2) != plain {
+		t.Fatalf("NewDecryptReader %q %v", plain2, err)
+	}
+}
+
+func TestEncryptKeyRotation(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local))
+	fs := NewMemFS(clock)
+	keys := newTestKeys(t, "k1", "k2")
+	logfile := newCryptLogFile(fs, clock, keys)
+	logfile.Write([]byte("[LOGINF] old key\n"))
+	//更换当前密钥后重新设置加密，下一次写入切换到新文件
+	keys.SetCurrent("k2")
+	logfile.SetEncryption(keys)
+	logfile.Write([]byte("[LOGINF] new key\n"))
+	logfile.Close()
+
+	names, contents := readSegments(t, fs, "/logs")
+	if want := []string{"rpc.svc.20240101.000000", "rpc.svc.20240101.000001"}; fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Fatalf("segments %v, want %v", names, want)
+	}
+	for i, want := range []string{"key=k1 ", "key=k2 "} {
+		if header, _ := splitFrames(t, contents[i]); !strings.Contains(string(header), want) {
+			t.Errorf("%s header %q", names[i], header)
+		}
+	}
+	for i, want := range []string{"[LOGINF] old key\n", "[LOGINF] new key\n"} {
+		if plain, err := decryptSegment(fs, "/logs/"+names[i], keys); err != nil || plain != want {
+			t.Errorf("%s: %q %v", names[i], plain, err)
+		}
+	}
+	//只有新密钥时旧文件无法解密
+	if _, err := decryptSegment(fs, "/logs/"+names[0], newTestKeys(t, "k2")); err == nil {
+		t.Error("decrypted with a missing key")
+	}
+}
+
+func TestEncryptTornFinalFrame(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local))
+	fs := NewMemFS(clock)
+	keys := newTestKeys(t, "k1")
+	logfile := newCryptLogFile(fs, clock, keys)
+	logfile.Write([]byte("[LOGINF] one\n"))
+	logfile.Write([]byte("[LOGINF] two\n"))
+	logfile.Close()
+
+	_, contents := readSegments(t, fs, "/logs")
+	writeMemFile(t, fs, "/logs/rpc.svc.20240101.000000", contents[0][:len(contents[0])-5])
+	plain, err := decryptSegment(fs, "/logs/rpc.svc.20240101.000000", keys)
+	if err != ErrTruncatedFrame || plain != "[LOGINF] one\n" {
+		t.Fatalf("decrypt torn segment: %q %v", plain, err)
+	}
+
+	//末尾帧不完整的文件不再追加
+	logfile = newCryptLogFile(fs, clock, keys)
+	logfile.Write([]byte("[LOGINF] three\n"))
+	logfile.Close()
+	names, _ := readSegments(t, fs, "/logs")
+	if len(names) != 2 {
+		t.Fatalf("segments %v", names)
+	}
+	if plain, err := decryptSegment(fs, "/logs/"+names[1], keys); err != nil || plain != "[LOGINF] three\n" {
+		t.Fatalf("%s: %q %v", names[1], plain, err)
+	}
+}
+
+func TestEncryptSplice(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local))
+	fs := NewMemFS(clock)
+	keys := newTestKeys(t, "k1")
+	logfile := newCryptLogFile(fs, clock, keys)
+	logfile.SetMaxLines(3)
+	for i := 0; i < 6; i++ {
+		logfile.Write([]byte(fmt.Sprintf("[LOGINF] line %d\n", i)))
+	}
+	logfile.Close()
+	names, contents := readSegments(t, fs, "/logs")
+	if len(names) != 2 {
+		t.Fatalf("segments %v", names)
+	}
+	header, frames := splitFrames(t, contents[0])
+	_, other := splitFrames(t, contents[1])
+	join := func(frames ...[]byte) []byte {
+		return bytes.Join(append([][]byte{header}, frames...), nil)
+	}
+
+	cases := map[string][]byte{
+		"drop middle frame":        join(frames[0], frames[2]),
+		"swap frames":              join(frames[1], frames[0], frames[2]),
+		"frame from other segment": join(frames[0], other[1], frames[2]),
+	}
+	for name, data := range cases {
+		writeMemFile(t, fs, "/logs/"+names[0], data)
+		if plain, err := decryptSegment(fs, "/logs/"+names[0], keys); err == nil {
+			t.Errorf("%s: decrypted %q", name, plain)
+		}
+	}
+	//整个文件复制为其他文件
+	writeMemFile(t, fs, "/logs/"+names[1], contents[0])
+	if plain, err := decryptSegment(fs, "/logs/"+names[1], keys); err == nil {
+		t.Errorf("copied segment: decrypted %q", plain)
+	}
+}
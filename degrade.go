@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"runtime/debug"
+	"time"
+)
+
+const (
+	diagInterval = 10 * time.Second //降级诊断日志最小间隔
+	minBackoff   = time.Second
+	maxBackoff   = time.Minute
+)
+
+//SetFallbackPath 设置日志目录不可写时的备用目录，为空时降级输出到stderr
+func (logfile *LogFile) SetFallbackPath(fpath string) {
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	logfile.fallbackpath = fpath
+}
+
+//SetErrorHandler 设置日志文件打开、写入失败时的回调，在单独的协程中执行
+func (logfile *LogFile) SetErrorHandler(handler func(err error)) {
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	logfile.onerror = handler
+}
+
+//Degraded 日志是否处于降级输出状态
+func (logfile *LogFile) Degraded() bool {
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	return logfile.degraded
+}
+
+//degrade 日志目录打开或写入失败，切换到备用目录，备用目录也失败时切换到stderr，调用前需持有lock
+func (logfile *LogFile) degrade(err error) {
+	logfile.report(err)
+	logfile.schedule()
+	if logfile.degraded && isStderr(logfile.file) {
+		return
+	}
+
+	old := logfile.segment()
+	if logfile.file != nil {
+		logfile.closeFile(logfile.file)
+	}
+	logfile.file = os.Stderr
+	//开启加密时stderr同样输出密文，可用decrypt命令解密
+	if logfile.keys != nil {
+		if file, err := encryptFile(os.Stderr, logfile.keys); err == nil {
+			logfile.file = file
+		}
+	}
+	if !logfile.degraded && logfile.fallbackpath != "" {
+		fallback := *logfile
+		fallback.filepath = logfile.fallbackpath
+		if file, err := logfile.open(fallback); err == nil {
+			logfile.file = file
+		} else {
+			logfile.report(err)
+		}
+	}
+	logfile.degraded = true
+	logfile.filesize = 0
+	if fInfo, err := logfile.file.Stat(); err == nil && fInfo.Mode().IsRegular() {
+		logfile.filesize = fInfo.Size()
+	}
+	logfile.segstart = logfile.clock.Now()
+	logfile.emit(old, logfile.segment())
+}
+
+//schedule 按指数退避计算下次重试时间，调用前需持有lock
+func (logfile *LogFile) schedule() {
+	if logfile.backoff < minBackoff {
+		logfile.backoff = minBackoff
+	} else if logfile.backoff *= 2; logfile.backoff > maxBackoff {
+		logfile.backoff = maxBackoff
+	}
+	logfile.retryat = logfile.clock.Now().Add(logfile.backoff)
+}
+
+//retryPrimary 降级状态下按退避时间重新打开日志目录，调用前需持有lock
+func (logfile *LogFile) retryPrimary(now time.Time) {
+	if !logfile.degraded || now.Before(logfile.retryat) {
+		return
+	}
+	file, err := logfile.open(*logfile)
+	if err != nil {
+		logfile.report(err)
+		logfile.schedule()
+		return
+	}
+	old := logfile.segment()
+	logfile.closeFile(logfile.file)
+	logfile.file = file
+	logfile.degraded = false
+	logfile.backoff = 0
+	logfile.filesize = 0
+	if fInfo, err := file.Stat(); err == nil {
+		logfile.filesize = fInfo.Size()
+	}
+	logfile.scanSegment(file)
+	logfile.segstart = now
+	logfile.emit(old, logfile.segment())
+	logfile.updateLink()
+	stdlog.Println("log file recovered: ", file.Name())
+}
+
+//report 限频输出诊断日志并调用错误回调，调用前需持有lock
+func (logfile *LogFile) report(err error) {
+	if handler := logfile.onerror; handler != nil {
+		go func() {
+			defer func() {
+				if e := recover(); e != nil {
+					stdlog.Printf("log error handler panic: %v\n%s", e, debug.Stack())
+				}
+			}()
+			handler(err)
+		}()
+	}
+	now := logfile.clock.Now()
+	if now.Sub(logfile.lastdiag) < diagInterval {
+		logfile.suppressed++
+		return
+	}
+	if logfile.suppressed > 0 {
+		stdlog.Printf("log file degraded: %s (%d similar errors suppressed)", err, logfile.suppressed)
+	} else {
+		stdlog.Println("log file degraded: ", err)
+	}
+	logfile.lastdiag = now
+	logfile.suppressed = 0
+}
+
+func isStderr(file File) bool {
+	if c, ok := file.(*cryptFile); ok {
+		file = c.File
+	}
+	return file == File(os.Stderr)
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+//diskFree 目录所在文件系统的可用空间(非root用户可用)和总空间，单位字节
+func diskFree(dir string) (free uint64, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize), nil
+}
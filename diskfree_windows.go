@@ -0,0 +1,15 @@
+package main
+
+import "golang.org/x/sys/windows"
+
+//diskFree 目录所在磁盘的可用空间(当前用户可用)和总空间，单位字节
+func diskFree(dir string) (free uint64, total uint64, err error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := windows.GetDiskFreeSpaceEx(path, &free, &total, nil); err != nil {
+		return 0, 0, err
+	}
+	return free, total, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//SegmentInfo 日志文件信息，Start/End为本进程写入该文件的时间范围
+type SegmentInfo struct {
+	Path  string
+	Size  int64
+	Start time.Time
+	End   time.Time
+}
+
+//SegmentEvent 日志文件切换事件，OnOpen时Old为空，OnClose时New为空
+//开启压缩时旧文件在OnRotate返回后才压缩，回调中可以读取Old.Path
+type SegmentEvent struct {
+	Old SegmentInfo
+	New SegmentInfo
+}
+
+//Callbacks 日志文件生命周期回调，在单独的协程中按顺序执行，panic会被捕获
+type Callbacks struct {
+	OnOpen   func(event SegmentEvent) //首次打开日志文件
+	OnRotate func(event SegmentEvent) //按大小、时间切分或Reopen
+	OnClose  func(event SegmentEvent) //LogFile关闭
+}
+
+//notifier 回调事件队列
+type notifier struct {
+	callbacks Callbacks
+	lock      sync.Mutex
+	cond      *sync.Cond
+	queue     []notice
+	closed    bool
+	done      chan struct{}
+}
+
+//notice 回调队列中的一项：文件切换事件，或在之前的回调执行完后执行的操作
+type notice struct {
+	event SegmentEvent
+	then  func()
+}
+
+//SetCallbacks 设置日志文件生命周期回调
+func (logfile *LogFile) SetCallbacks(callbacks Callbacks) {
+	n := &notifier{callbacks: callbacks, done: make(chan struct{})}
+	n.cond = sync.NewCond(&n.lock)
+	go n.run()
+	logfile.lock.Lock()
+	old := logfile.notifier
+	logfile.notifier = n
+	logfile.lock.Unlock()
+	if old != nil {
+		old.close()
+	}
+}
+
+//segment 当前日志文件信息，调用前需持有lock
+func (logfile *LogFile) segment() SegmentInfo {
+	if logfile.file == nil {
+		return SegmentInfo{}
+	}
+	info := SegmentInfo{
+		Path:  logfile.file.Name(),
+		Size:  atomic.LoadInt64(&logfile.filesize),
+		Start: logfile.segstart,
+		End:   logfile.segstart,
+	}
+	if last := atomic.LoadInt64(&logfile.lastwrite); last > info.Start.UnixNano() {
+		info.End = time.Unix(0, last)
+	}
+	return info
+}
+
+//emit 发送文件切换事件，调用前需持有lock
+func (logfile *LogFile) emit(old SegmentInfo, cur SegmentInfo) {
+	if logfile.notifier == nil {
+		return
+	}
+	logfile.notifier.push(notice{event: SegmentEvent{Old: old, New: cur}})
+}
+
+//after 已加入队列的回调执行完后执行fn，没有设置回调时立即执行，调用前需持有lock
+func (logfile *LogFile) after(fn func()) {
+	if logfile.notifier == nil || !logfile.notifier.push(notice{then: fn}) {
+		fn()
+	}
+}
+
+//push 加入回调队列，notifier已关闭时返回false
+func (n *notifier) push(item notice) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closed {
+		return false
+	}
+	n.queue = append(n.queue, item)
+	n.cond.Signal()
+	return true
+}
+
+func (n *notifier) run() {
+	defer close(n.done)
+	for {
+		n.lock.Lock()
+		for len(n.queue) == 0 && !n.closed {
+			n.cond.Wait()
+		}
+		if len(n.queue) == 0 {
+			n.lock.Unlock()
+			return
+		}
+		item := n.queue[0]
+		n.queue = n.queue[1:]
+		n.lock.Unlock()
+		if item.then != nil {
+			item.then()
+		} else {
+			n.dispatch(item.event)
+		}
+	}
+}
+
+func (n *notifier) dispatch(event SegmentEvent) {
+	var fn func(SegmentEvent)
+	switch {
+	case event.Old.Path == "":
+		fn = n.callbacks.OnOpen
+	case event.New.Path == "":
+		fn = n.callbacks.OnClose
+	default:
+		fn = n.callbacks.OnRotate
+	}
+	if fn == nil {
+		return
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			stdlog.Printf("log callback panic: %v\n%s", err, debug.Stack())
+		}
+	}()
+	fn(event)
+}
+
+//close 执行完队列中剩余回调后退出
+func (n *notifier) close() {
+	n.lock.Lock()
+	n.closed = true
+	n.cond.Broadcast()
+	n.lock.Unlock()
+	<-n.done
+}
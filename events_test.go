@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRotateCallbackBeforeCompress(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local))
+	fs := NewMemFS(clock)
+	logfile := newTestLogFile(fs, clock)
+	logfile.SetMaxLines(1)
+	logfile.SetCompress(CompressGzip)
+	read := make(chan string, 1)
+	logfile.SetCallbacks(Callbacks{OnRotate: func(event SegmentEvent) {
+		//压缩在回调返回后才开始，旧文件仍可读取
+		time.Sleep(20 * time.Millisecond)
+		file, err := fs.OpenFile(event.Old.Path, os.O_RDONLY, 0)
+		if err != nil {
+			read <- err.Error()
+			return
+		}
+		defer file.Close()
+		data, _ := ioutil.ReadAll(file)
+		read <- string(data)
+	}})
+	logfile.Write([]byte("[LOGINF] a\n"))
+	logfile.Write([]byte("[LOGINF] b\n"))
+	if got := <-read; got != "[LOGINF] a\n" {
+		t.Fatalf("OnRotate read %q", got)
+	}
+	logfile.Close()
+
+	names, _ := readSegments(t, fs, "/logs")
+	want := []string{"rpc.svc.20240101.000000.gz", "rpc.svc.20240101.000001"}
+	if fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Fatalf("segments %v, want %v", names, want)
+	}
+}
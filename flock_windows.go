@@ -0,0 +1,17 @@
+package main
+
+import (
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+//lockFile 对文件加排他锁，阻塞直到获得锁
+func lockFile(file *os.File) error {
+	ol := new(windows.Overlapped)
+	return windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, ol)
+}
+
+func unlockFile(file *os.File) error {
+	ol := new(windows.Overlapped)
+	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, ol)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	sequences "github.com/konsorten/go-windows-terminal-sequences"
 	"github.com/sirupsen/logrus"
+	"hash/crc32"
 	"io"
 	"os"
 	"reflect"
@@ -13,6 +14,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 const (
 	defaultTimestampFormat = "15:04:05.000000"
@@ -23,11 +25,13 @@ const (
 	FieldKeyFunc           = "func"
 	FieldKeyFile           = "file"
 	FieldKeyDate           = "date"
+	FieldKeyCalDate        = "caldate"
 	FieldKeyMicroSecond    = "microsecond"
 	FieldKeyPid            = "pid"
 	FieldKeyGoid           = "goid"
 	defaultDateFormat      = "20060102"
     FieldKeyBankNo           = "bank"
+	FieldKeyCRC            = "crc"
 )
 
 
@@ -85,6 +89,11 @@ func prefixFieldClashes(data logrus.Fields, fieldMap FieldMap, reportCaller bool
 		data["fields."+dateKey] = t
 		delete(data, dateKey)
 	}
+	calDateKey := fieldMap.resolve(FieldKeyCalDate)
+	if t, ok := data[calDateKey]; ok {
+		data["fields."+calDateKey] = t
+		delete(data, calDateKey)
+	}
 	microsecondKey := fieldMap.resolve(FieldKeyMicroSecond)
 	if t, ok := data[microsecondKey]; ok {
 		data["fields."+microsecondKey] = t
@@ -217,6 +226,16 @@ type Formatter struct {
 	DisableGoid bool
 	DisableMicroSecond bool
 	
+	// DateProvider 设置后date列输出会计日期，并增加caldate列输出自然日期
+	DateProvider DateProvider
+	DisableCalDate bool
+	
+	// Clock 设置后时间戳使用Clock的当前时间代替entry.Time，用于测试
+	Clock Clock
+	
+	// LineCRC 开启后每条日志首列输出[crc = 8位十六进制]，为该条日志其余内容(不含末尾换行)的CRC32，用ValidateCRC校验
+	LineCRC bool
+	
 	// QuoteEmptyFields will wrap empty fields in quotes if true
 	QuoteEmptyFields bool
 	
@@ -249,6 +268,7 @@ func (f *Formatter) init(entry *logrus.Entry) {
 
 // Format renders a single log entry
 func (f *Formatter) Format(entry *logrus.Entry) ([]byte, error) {
+	defer countEntry(entry.Level, time.Now())
 	data := make(logrus.Fields)
 	for k, v := range entry.Data {
 		data[k] = v
@@ -268,6 +288,9 @@ func (f *Formatter) Format(entry *logrus.Entry) ([]byte, error) {
 	if !f.DisableDate{
 		fixedKeys = append(fixedKeys,f.FieldMap.resolve(FieldKeyDate))
 	}
+	if f.DateProvider != nil && !f.DisableCalDate {
+		fixedKeys = append(fixedKeys, f.FieldMap.resolve(FieldKeyCalDate))
+	}
 	if !f.DisableTimestamp {
 		fixedKeys = append(fixedKeys, f.FieldMap.resolve(FieldKeyTime))
 	}
@@ -331,6 +354,7 @@ func (f *Formatter) Format(entry *logrus.Entry) ([]byte, error) {
 	}
 	
 	f.terminalInitOnce.Do(func() { f.init(entry) })
+	start := b.Len()
 	
 	timestampFormat := f.TimestampFormat
 	if timestampFormat == "" {
@@ -340,10 +364,14 @@ func (f *Formatter) Format(entry *logrus.Entry) ([]byte, error) {
 	if dateFormat == "" {
 		dateFormat = defaultDateFormat
 	}
+	entryTime := entry.Time
+	if f.Clock != nil {
+		entryTime = f.Clock.Now()
+	}
 	var microsecond string
 	var clock string
 	if !f.DisableMicroSecond || !f.DisableTimestamp{
-		time := entry.Time.Format(timestampFormat)
+		time := entryTime.Format(timestampFormat)
 		str := strings.Split(time,".")
 		microsecond = str[len(str)-1]
 		clock = str[0]
@@ -367,7 +395,15 @@ func (f *Formatter) Format(entry *logrus.Entry) ([]byte, error) {
 		case key == f.FieldMap.resolve(FieldKeyFile) && entry.HasCaller():
 			value = fileVal
 		case key == f.FieldMap.resolve(FieldKeyDate):
-			value = entry.Time.Format(dateFormat)
+			if f.DateProvider != nil {
+				date, _, _ := f.DateProvider.BusinessDay(entryTime)
+				value = date.Format(dateFormat)
+			} else {
+				value = entryTime.Format(dateFormat)
+			}
+		case key == f.FieldMap.resolve(FieldKeyCalDate):
+			value = entryTime.Format(dateFormat)
+			flag = true
 		case key == f.FieldMap.resolve(FieldKeyMicroSecond):
 			value = microsecond
 		case key == f.FieldMap.resolve(FieldKeyPid):
@@ -383,6 +419,13 @@ func (f *Formatter) Format(entry *logrus.Entry) ([]byte, error) {
 		
 		f.appendKeyValue(b, key, value,flag)
 	}
+	if f.LineCRC {
+		//crc列放在行首，计算其余内容后插入
+		line := append([]byte(nil), b.Bytes()[start:]...)
+		b.Truncate(start)
+		f.appendKeyValue(b, FieldKeyCRC, fmt.Sprintf("%08x", crc32.ChecksumIEEE(line)), true)
+		b.Write(line)
+	}
 	
 	b.WriteByte('\n')
 	return b.Bytes(), nil
@@ -421,11 +464,17 @@ func (f *Formatter) appendKeyValue(b *bytes.Buffer, key string, value interface{
 	b.WriteByte(']')
 }
 
+//日志内容中的换行转义为\n，每条日志只占一行
+var newlineEscaper = strings.NewReplacer("\r", `\r`, "\n", `\n`)
+
 func (f *Formatter) appendValue(b *bytes.Buffer, value interface{}) {
 	stringVal, ok := value.(string)
 	if !ok {
 		stringVal = fmt.Sprint(value)
 	}
+	if strings.ContainsAny(stringVal, "\r\n") {
+		stringVal = newlineEscaper.Replace(stringVal)
+	}
 	
 	//if !f.needsQuoting(stringVal) {
 		b.WriteString(stringVal)
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+//File LogFile写入、压缩使用的文件接口，*os.File已实现
+type File interface {
+	io.Reader
+	io.Writer
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+}
+
+//FileSystem LogFile使用的文件系统接口，默认为OSFS，测试中可使用MemFS
+type FileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Rename(oldpath string, newpath string) error
+	Remove(name string) error
+	ReadDir(dirname string) ([]os.FileInfo, error)
+}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) Rename(oldpath string, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirname)
+}
+
+//OSFS 操作系统文件系统
+var OSFS FileSystem = osFS{}
+
+//SetFileSystem 设置LogFile使用的文件系统，为nil时使用OSFS，需在第一次写入前设置
+//多进程共享模式的锁文件和current软链接依赖操作系统文件系统，非OSFS时不生效
+func (logfile *LogFile) SetFileSystem(fs FileSystem) {
+	if fs == nil {
+		fs = OSFS
+	}
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	logfile.fs = fs
+	if zipper := logfile.zipper; zipper != nil {
+		zipper.lock.Lock()
+		zipper.fs = fs
+		zipper.lock.Unlock()
+	}
+}
@@ -9,6 +9,8 @@ import (
     "path/filepath"
     "reflect"
     "sync"
+    "sync/atomic"
+    "time"
 )
 
 
@@ -112,16 +114,19 @@ func (hook *RpcHook) SetDefaultWriter(defaultWriter io.Writer) {
 
 // Fire writes the log file to defined path or using the defined writer.
 // User who run this function needs write permissions to the file or directory if the file does not yet exist.
-func (hook *RpcHook) Fire(entry *logrus.Entry) error {
+func (hook *RpcHook) Fire(entry *logrus.Entry) (err error) {
+    defer metrics.hook.since(time.Now())
     hook.lock.Lock()
     defer hook.lock.Unlock()
     if hook.writers != nil || hook.hasDefaultWriter {
-        return hook.ioWrite(entry)
+        err = hook.ioWrite(entry)
     } else if hook.paths != nil || hook.hasDefaultPath {
-        return hook.fileWrite(entry)
+        err = hook.fileWrite(entry)
     }
-    
-    return nil
+    if err != nil {
+        atomic.AddUint64(&metrics.hookerr, 1)
+    }
+    return err
 }
 
 // Write a log line to an io.Writer.
@@ -187,8 +192,8 @@ func (hook *RpcHook) fileWrite(entry *logrus.Entry) error {
         log.Println("failed to generate string for entry:", err)
         return err
     }
-    fd.Write(msg)
-    return nil
+    _, err = fd.Write(msg)
+    return err
 }
 
 // Levels returns configured log levels.
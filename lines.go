@@ -0,0 +1,32 @@
+package main
+
+//SetMaxLines 设置单个日志文件最大日志条数(一次Write为一条，多行日志算一条)，0不限制
+//与maxsize、按时间切分同时生效，任一条件满足即切分；多进程共享模式下不支持
+//重启后按已有文件的行数恢复条数，Formatter会转义日志内容中的换行，每条日志只占一行
+func (logfile *LogFile) SetMaxLines(lines int64) {
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	if lines < 0 {
+		lines = 0
+	}
+	logfile.maxlines = lines
+	if logfile.file != nil {
+		logfile.scanSegment(logfile.file)
+	}
+}
+
+//isEntryStart 已有文件中按行首'['识别一条日志的开始，其余行属于上一条日志
+func isEntryStart(line []byte) bool {
+	return len(line) > 0 && line[0] == '['
+}
+
+//completeEntries entries中前n字节包含的完整日志条数
+func completeEntries(entries [][]byte, n int) int {
+	for i, entry := range entries {
+		if n < len(entry) {
+			return i
+		}
+		n -= len(entry)
+	}
+	return len(entries)
+}
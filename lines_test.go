@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"testing"
+	"time"
+)
+
+//newTestLogger 使用Formatter写入logfile的logrus.Logger
+func newTestLogger(logfile *LogFile, clock Clock) *logrus.Logger {
+	logger := logrus.New()
+	logger.SetFormatter(&Formatter{Clock: clock, DisablePid: true, DisableGoid: true})
+	logger.SetOutput(logfile)
+	return logger
+}
+
+func TestMaxLinesResumeMultilineMessage(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local))
+	fs := NewMemFS(clock)
+	logfile := newTestLogFile(fs, clock)
+	logfile.SetMaxLines(3)
+	logger := newTestLogger(logfile, clock)
+	logger.Info("hello\n[bracket] continuation")
+	logger.Info("second\n[bracket] continuation")
+	logfile.Close()
+
+	//重启后按两条日志恢复，第三条仍写入同一文件
+	logfile = newTestLogFile(fs, clock)
+	logfile.SetMaxLines(3)
+	logger = newTestLogger(logfile, clock)
+	logger.Info("third")
+	logger.Info("fourth")
+	logfile.Close()
+
+	names, contents := readSegments(t, fs, "/logs")
+	if want := []string{"rpc.svc.20240101.000000", "rpc.svc.20240101.000001"}; fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Fatalf("segments %v, want %v", names, want)
+	}
+	if lines := bytes.Count(contents[0], []byte{'\n'}); lines != 3 {
+		t.Fatalf("first segment has %d lines:\n%s", lines, contents[0])
+	}
+	if !bytes.Contains(contents[0], []byte(`hello\n[bracket] continuation`)) {
+		t.Fatalf("newline not escaped:\n%s", contents[0])
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+//SetCurrentLink 开启后在日志目录下维护backend.service.current软链接，指向当前正在写入的文件
+func (logfile *LogFile) SetCurrentLink(enable bool) {
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	logfile.currentlink = enable
+	if enable && logfile.file != nil {
+		logfile.updateLink()
+	}
+}
+
+//linkPath 软链接路径
+func (logfile *LogFile) linkPath() string {
+	return filepath.Join(logfile.filepath, logfile.backendname+"."+logfile.servicename+".current")
+}
+
+//updateLink 先创建临时软链接再rename覆盖，保证切换是原子的，调用前需持有lock
+func (logfile *LogFile) updateLink() {
+	if !logfile.currentlink || logfile.file == nil || logfile.degraded || logfile.fs != OSFS {
+		return
+	}
+	link := logfile.linkPath()
+	target, err := filepath.Rel(filepath.Dir(link), logfile.file.Name())
+	if err != nil {
+		target = logfile.file.Name()
+	}
+	if cur, err := os.Readlink(link); err == nil && cur == target {
+		return
+	}
+	tmp := link + "." + strconv.Itoa(os.Getpid()) + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		stdlog.Println("create current link error: ", err)
+		return
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		stdlog.Println("update current link error: ", err)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
     "github.com/rifflock/lfshook"
     "github.com/sirupsen/logrus"
+    "io"
     "os"
     "strings"
     "time"
@@ -10,6 +11,8 @@ import (
 
 var (
     Logger      = logrus.New()
+    AuditLogger = logrus.New() //审计日志，每行带HMAC链，配置auditkey后生效
+    pressure    *DiskPressure  //磁盘空间不足时提高Logger级别，配置watermark后生效
     timeFormat  = "15:04:05.000000"
     dateFormat  = "20060102"
 )
@@ -17,28 +20,88 @@ var (
 
 
 func InitLog(cfg *LogCfg) {
+    InitLogWithClock(cfg, SystemClock)
+}
+
+//InitLogWithClock 使用指定的时钟初始化日志，测试中可传入FakeClock，此时时间戳也使用该时钟(忽略WithTime)
+func InitLogWithClock(cfg *LogCfg, clock Clock) {
     if cfg == nil{
         panic("config.LogCfg is nil.")
     }
+    if clock == nil {
+        clock = SystemClock
+    }
+    //多进程共享模式下切分判断只按大小和时间
+    if cfg.Shared && (cfg.MaxLines > 0 || cfg.EncryptKey != "" || cfg.AuditKey != "" || cfg.StallTime > 0 || cfg.Deadline > 0) {
+        panic(ErrSharedConflict)
+    }
     
     //初始化log level
     level := logLevelforCfg(cfg.LogLevel)
     //初始化writer
     writer := NewLogFile()
     writer.SetMaxSize(cfg.MaxFileSize)
+    writer.SetMaxLines(cfg.MaxLines)
     writer.SetBackendName(cfg.BackendName)
     writer.SetServiceName(cfg.ServerName)
-    writer.SetCurDate(time.Now().Format("20060102"))
+    writer.SetClock(clock)
+    writer.SetCurDate(clock.Now().Format("20060102"))
+    writer.SetRotateInterval(cfg.RotateTime)
     fpath := os.Getenv("GOPATH")
     writer.SetFilePath(fpath)
+    if err := writer.SetNameTemplate(cfg.NameFormat); err != nil {
+        panic(err)
+    }
+    writer.SetCurrentLink(cfg.CurrentLink)
+    writer.SetFallbackPath(cfg.Fallback)
+    if err := writer.SetShared(cfg.Shared); err != nil {
+        panic(err)
+    }
+    writer.SetHeaderFooter(cfg.Header, cfg.LogField)
+    keys, err := encryptKeysforCfg(cfg.EncryptKey)
+    if err != nil {
+        panic(err)
+    }
+    writer.SetEncryption(keys)
+    //初始化会计日期
+    var provider DateProvider
+    cutover, err := dateProviderforCfg(cfg.Cutover, cfg.TimeZone)
+    if err != nil {
+        panic(err)
+    }
+    bizdate = cutover
+    if cutover != nil {
+        provider = cutover
+        writer.SetDateProvider(provider)
+    }
+    if cfg.ReopenSig != "" {
+        sig, err := reopenSignalforCfg(cfg.ReopenSig)
+        if err != nil {
+            panic(err)
+        }
+        HandleReopenSignal(sig)
+    }
+    writer.SetCleanPolicy(CleanPolicy{
+        MaxAge: time.Duration(cfg.MaxAge) * 24 * time.Hour,
+        MaxCount: cfg.MaxFiles,
+        MaxBytes: cfg.MaxDirSize * 1024 * 1024,
+        ArchivePath: cfg.ArchivePath,
+    }, time.Minute)
+    writer.SetCompress(cfg.Compress)
+    writer.SetSyncPolicy(syncPolicyforCfg(cfg.SyncPolicy), time.Duration(cfg.SyncTime) * time.Millisecond)
+    writer.SetWatchdog(time.Duration(cfg.StallTime) * time.Millisecond, stallPolicyforCfg(cfg.StallPolicy), nil)
+    writer.SetWriteDeadline(time.Duration(cfg.Deadline) * time.Millisecond)
     
     //初始化Formatter
     field := logfieldtoFormatMap(cfg.LogField)
+    //系统时钟时使用entry.Time，保留WithTime指定的时间
+    var fclock Clock
+    if clock != SystemClock {
+        fclock = clock
+    }
     
     //初始化Logger变量
-    Logger.SetReportCaller(true)
-    Logger.SetLevel(level)
-    Logger.SetFormatter(&Formatter{
+    formatter := &Formatter{
         TimestampFormat: timeFormat,
         DateFormat: dateFormat,
         DisableDate:field[FieldKeyDate],
@@ -46,19 +109,99 @@ func InitLog(cfg *LogCfg) {
         DisableMicroSecond:field[FieldKeyMicroSecond],
         DisablePid:field[FieldKeyPid],
         DisableGoid:field[FieldKeyGoid],
-    })
+        DateProvider:provider,
+        Clock:fclock,
+        LineCRC:cfg.LineCRC,
+    }
+    Logger.SetReportCaller(true)
+    Logger.SetLevel(level)
+    Logger.SetFormatter(formatter)
     
     //Logger.AddHook(newLfsHook())  //用hook处理文件多个输出流
     //Logger.SetOutput(ioutil.Discard)
-    Logger.SetOutput(writer)//不同级别的日志输出到同一文件中
+    old := Logger.Out
+    if cfg.AsyncQueue > 0 {
+        Logger.SetOutput(NewAsyncWriter(writer, cfg.AsyncQueue, overflowPolicyforCfg(cfg.AsyncPolicy)))
+    } else {
+        Logger.SetOutput(writer)//不同级别的日志输出到同一文件中
+    }
+    closeOutput(old)
+    
+    //磁盘空间低于水位线时提高日志级别，恢复后还原为level
+    marks, err := watermarksforCfg(cfg.Watermark)
+    if err != nil {
+        panic(err)
+    }
+    if pressure != nil {
+        pressure.Close()
+        pressure = nil
+    }
+    if len(marks) > 0 {
+        pressure = NewDiskPressure(Logger, writer, marks, 0)
+    }
+    
+    //初始化审计日志，写入服务名.audit文件，每条日志同步落盘
+    if cfg.AuditKey != "" {
+        key, err := LoadKeyFile(cfg.AuditKey)
+        if err != nil {
+            panic(err)
+        }
+        audit := NewLogFile()
+        audit.SetMaxSize(cfg.MaxFileSize)
+        audit.SetBackendName(cfg.BackendName)
+        audit.SetServiceName(cfg.ServerName + ".audit")
+        audit.SetClock(clock)
+        audit.SetCurDate(clock.Now().Format("20060102"))
+        audit.SetRotateInterval(cfg.RotateTime)
+        audit.SetFilePath(fpath)
+        if err := audit.SetNameTemplate(cfg.NameFormat); err != nil {
+            panic(err)
+        }
+        audit.SetFallbackPath(cfg.Fallback)
+        if provider != nil {
+            audit.SetDateProvider(provider)
+        }
+        audit.SetHeaderFooter(true, cfg.LogField)
+        audit.SetEncryption(keys)
+        audit.SetAudit(key)
+        audit.SetSyncPolicy(SyncAlways, 0)
+        AuditLogger.SetReportCaller(true)
+        AuditLogger.SetLevel(logrus.InfoLevel)
+        AuditLogger.SetFormatter(formatter)
+        old := AuditLogger.Out
+        AuditLogger.SetOutput(audit)
+        closeOutput(old)
+    }
+    
+    //日志指标：/metrics、/debug/vars，重复InitLog时地址不变则复用，未配置时关闭
+    if cfg.MetricsAddr != "" {
+        if err := ServeMetrics(cfg.MetricsAddr); err != nil {
+            panic(err)
+        }
+    } else {
+        StopMetrics()
+    }
 
 }
+//closeOutput 重复InitLog时关闭之前创建的writer，不再统计指标，stderr等外部writer不关闭
+func closeOutput(out io.Writer) {
+    switch out.(type) {
+    case *LogFile, *AsyncWriter:
+        if err := out.(io.Closer).Close(); err != nil {
+            stdlog.Println("log close file error: ", err)
+        }
+    }
+}
 //close file pointer
 func Close(){
-    lg,ok := Logger.Out.(*LogFile)
-    if ok {
-        if lg.file != nil{
-            err := lg.file.Close()
+    if pressure != nil {
+        pressure.Close()
+        pressure = nil
+    }
+    for _, logger := range []*logrus.Logger{Logger, AuditLogger} {
+        lg,ok := logger.Out.(io.Closer)
+        if ok {
+            err := lg.Close()
             if err != nil{
                 stdlog.Println("log close file error: ",err)
             }
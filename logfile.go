@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -19,24 +21,85 @@ var stdlog = log.New(os.Stdout, "srpc/log: ", log.LstdFlags|log.Lshortfile)
 
 type LogFile struct {
 	lock     *sync.Mutex
-	file     *os.File
+	file     File
+	closed   bool //Close后不再打开新文件
 	filepath string
 	filesize int64
 	maxsize  int64
+	//按条切分：maxlines为0不限制，一次Write为一条日志(可能包含多行)
+	maxlines int64
+	curlines int64
 	curindex int64
 	//maxindex     int64
 	backendname string
 	servicename string
 	curdate     string //format:YYYYMMDD
+	//按时间切分：interval为0按天切分，否则每interval分钟切分一次
+	interval  int64
+	curwindow string //format:HHMM，按天切分时为空
+	windowend time.Time
+	cleaner   *cleaner
+	zipper    *compressor
+	//落盘策略
+	syncpolicy SyncPolicy
+	syncer     *syncer
+	naming     *nameTemplate //文件命名模板
+	//是否维护backend.service.current软链接
+	currentlink bool
+	//生命周期回调
+	notifier  *notifier
+	segstart  time.Time
+	lastwrite int64 //UnixNano
+	//降级输出
+	fallbackpath string
+	degraded     bool
+	retryat      time.Time
+	backoff      time.Duration
+	onerror      func(err error)
+	lastdiag     time.Time
+	suppressed   int
+	//多进程共享模式
+	shared   bool
+	lockfile *os.File
+	//会计日期，为nil时按自然日
+	dateprovider DateProvider
+	clock        Clock
+	fs           FileSystem
+	//文件头尾记录
+	meta     bool
+	logfield string
+	prevseg  string //上一个日志文件名
+	headsize int64
+	crc      uint32
+	first    time.Time
+	last     time.Time
+	//审计模式：hmac链
+	auditkey []byte
+	chain    []byte
+	//加密
+	keys   KeyProvider
+	sealed bool //当前文件不能继续追加(加密状态、密钥不一致或末尾帧不完整)
+	//写入指标，openFile等按值传递LogFile，使用指针
+	stats *fileStats
+	//写入卡住检测
+	watchdog watchdog
 }
 
 func NewLogFile() *LogFile {
-	return &LogFile{lock: new(sync.Mutex),
+	naming, _ := parseNameTemplate(DefaultNameTemplate)
+	logfile := &LogFile{lock: new(sync.Mutex),
 		maxsize:  DefaultSize,
 		filepath: DefaultPath,
 		curindex: 0,
-		curdate:  time.Now().Format(defaultDateFormat),
+		curdate:  SystemClock.Now().Format(defaultDateFormat),
+		naming:   naming,
+		clock:    SystemClock,
+		fs:       OSFS,
+		stats:    &fileStats{id: nextMetricsID()},
 	}
+	logfile.setStatsName()
+	registerLogFile(logfile)
+	return logfile
 }
 func (logfile *LogFile) SetMaxSize(size int64) {
 	logfile.lock.Lock()
@@ -48,126 +111,433 @@ func (logfile *LogFile) SetBackendName(backendname string) {
 	logfile.lock.Lock()
 	defer logfile.lock.Unlock()
 	logfile.backendname = backendname
+	logfile.setStatsName()
 }
 func (logfile *LogFile) SetServiceName(servicename string) {
 	logfile.lock.Lock()
 	defer logfile.lock.Unlock()
 	logfile.servicename = servicename
+	logfile.setStatsName()
 }
 func (logfile *LogFile) SetCurDate(curdate string) {
 	logfile.lock.Lock()
 	defer logfile.lock.Unlock()
 	logfile.curdate = curdate
 }
+//SetRotateInterval 设置按时间切分日志的间隔(分钟)，0按天，60按小时
+func (logfile *LogFile) SetRotateInterval(minutes int64) {
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	if minutes < 0 || minutes >= 24*60 {
+		minutes = 0
+	}
+	logfile.interval = minutes
+	logfile.windowend = time.Time{}
+}
 func (logfile *LogFile) SetFilePath(fpath string) {
 	logfile.lock.Lock()
 	defer logfile.lock.Unlock()
 	//dir := filepath.Dir(fpath)
-	dirinfo, err := os.Stat(fpath)
+	dirinfo, err := logfile.fs.Stat(fpath)
 	if err == nil && !dirinfo.IsDir() {
 		err = fmt.Errorf("%s already exists and not a directory", fpath)
 	}
 	if os.IsExist(err) {
-		if err := os.MkdirAll(fpath, 0755); err != nil {
+		if err := logfile.fs.MkdirAll(fpath, 0755); err != nil {
 			err = fmt.Errorf(" create %s directory error: %s", fpath, err)
 		}
 	}
 	logfile.filepath = fpath
 }
+//Close 落盘并关闭当前文件，之后的写入返回os.ErrClosed
 func (logfile *LogFile) Close() error {
+	logfile.SetCleanPolicy(CleanPolicy{}, 0)
+	logfile.SetCompress("")
+	logfile.stopSyncer()
+	unregisterLogFile(logfile)
+	logfile.lock.Lock()
+	logfile.closed = true
+	var err error
+	//卡住的文件不再落盘和关闭
+	stuck := logfile.stalled() && logfile.busy(logfile.file)
+	if logfile.file != nil && !stuck {
+		//关闭前总是落盘
+		if err := logfile.syncFile(logfile.file); err != nil {
+			stuck = isStall(err)
+			stdlog.Println("sync file error: ", err)
+		}
+	}
 	if logfile.file != nil {
-		err := logfile.file.Close()
-		return err
+		logfile.emit(logfile.segment(), SegmentInfo{})
+		if !stuck {
+			err = logfile.file.Close()
+		}
+		logfile.file = nil
+	}
+	if logfile.lockfile != nil {
+		logfile.lockfile.Close()
+		logfile.lockfile = nil
+	}
+	n := logfile.notifier
+	logfile.notifier = nil
+	logfile.lock.Unlock()
+	if n != nil {
+		n.close()
 	}
-	return nil
+	return err
+}
+//inUse 文件是否正在写入或等待压缩
+func (logfile *LogFile) inUse(fpath string) bool {
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	if logfile.file != nil && logfile.file.Name() == fpath {
+		return true
+	}
+	return logfile.zipper != nil && logfile.zipper.busy(fpath)
 }
 func (logfile *LogFile) SetFile() {
 	logfile.lock.Lock()
 	defer logfile.lock.Unlock()
+	logfile.setWindow(logfile.clock.Now())
+	logfile.setFile()
+	logfile.emit(SegmentInfo{}, logfile.segment())
+}
+
+//setFile 从已存在的最大序号继续写，调用前需持有lock
+func (logfile *LogFile) setFile() {
+	logfile.resumeChain()
+	if index := logfile.lastIndex(); index > logfile.curindex {
+		logfile.curindex = index
+	}
 	for {
-		file, err := openFile(*logfile)
+		//已压缩的文件视为已写满
+		if fpath, err := segmentFile(*logfile); err == nil && compressedExists(logfile.fs, fpath) {
+			logfile.curindex++
+			continue
+		}
+		file, err := logfile.open(*logfile)
 		if err != nil {
-			err = fmt.Errorf("SetFile open log file %s error: %s", logfile.filepath, err)
-			panic(err)
+			logfile.degrade(fmt.Errorf("SetFile open log file %s error: %s", logfile.filepath, err))
+			return
 		}
 		logfile.file = file
-		fInfo, _ := logfile.file.Stat()
-		if fInfo.Size() >= int64(logfile.maxsize*1024*1024) {
+		fInfo, err := logfile.file.Stat()
+		if err != nil {
+			logfile.degrade(fmt.Errorf("SetFile stat log file %s error: %s", file.Name(), err))
+			return
+		}
+		logfile.filesize = fInfo.Size()
+		logfile.scanSegment(file)
+		if logfile.full() {
 			logfile.curindex++
+			logfile.prevseg = filepath.Base(file.Name())
 			if err := logfile.file.Close(); err != nil {
 				stdlog.Println("close file error: ", err)
 			}
+			//共享模式下由切分的进程压缩
+			if !logfile.shared {
+				logfile.compress(file.Name())
+			}
 		} else {
 			//重启服务，从最后更新日志文件追
-			logfile.filesize = fInfo.Size()
+			logfile.segstart = logfile.clock.Now()
+			logfile.updateLink()
 			break
 		}
 	}
 }
 
+//Write 一次写入为一条日志，持有lock完成切分判断和写入，每条日志完整写入同一个文件，写入会超过maxsize或maxlines时先切分
 func (logfile *LogFile) Write(data []byte) (n int, e error) {
+	return logfile.WriteEntries([][]byte{data})
+}
+
+//WriteEntries 批量写入多条日志，超过剩余空间或行数时按条拆分到下一个文件
+func (logfile *LogFile) WriteEntries(entries [][]byte) (n int, e error) {
+	defer logfile.stats.write.since(time.Now())
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	if logfile.closed {
+		return 0, os.ErrClosed
+	}
+	now := logfile.clock.Now()
+	total := 0
+	for _, entry := range entries {
+		total += len(entry)
+	}
+	if logfile.shared {
+		if logfile.sharedConflict() {
+			return 0, ErrSharedConflict
+		}
+		return logfile.writeShared(bytes.Join(entries, nil), now)
+	}
+	//卡住的写入未完成前不切分、不重新打开日志目录
+	stalled := logfile.stalled()
+	if stalled && logfile.watchdog.policy != StallFallback {
+		return logfile.dropStalled(entries)
+	}
 	if logfile.file == nil {
-		logfile.SetFile()
-	}
-	date := time.Now().Format("20060102")
-	if logfile.curdate != date {
-		logfile.SetCurDate(date)
-	}
-	OldIndex := logfile.curindex
-	//fInfo, _ := logfile.file.Stat()
-	//if fInfo.Size() >= logfile.maxsize*1024*1024 {
-	//	logfile.lock.Lock()
-	//	//LogFile 加锁后重新判断其他协程是否已经修改
-	//	fInfo, _ = logfile.file.Stat()
-	//	if OldIndex == logfile.curindex && fInfo.Size() >= logfile.maxsize*1024*1024 {
-	//		logfile.curindex++
-	//		oldfile := logfile.file
-	//		file,err := openFile(*logfile)
-	//		if err != nil {
-	//			err = errors.New("write file open log file error: " + err.Error())
-	//			panic(err)
-	//		}
-	//		logfile.file = file
-	//		if err := oldfile.Close();err !=nil{
-	//			stdlog.Println("close file error: ",err)
-	//		}
-	//	}
-	//	logfile.lock.Unlock()
-	//}
-	if logfile.filesize >= logfile.maxsize*1024*1024 {
-		logfile.lock.Lock()
-		//LogFile 加锁后重新判断其他协程是否已经修改
-		fInfo, _ := logfile.file.Stat()
-		if OldIndex == logfile.curindex && fInfo.Size() >= logfile.maxsize*1024*1024 {
-			logfile.curindex++
-			oldfile := logfile.file
-			file, err := openFile(*logfile)
-			if err != nil {
-				err = errors.New("write file open log file error: " + err.Error())
-				panic(err)
+		logfile.setWindow(now)
+		logfile.setFile()
+		logfile.emit(SegmentInfo{}, logfile.segment())
+	} else if !stalled && !now.Before(logfile.windowend) {
+		logfile.rollWindow(now, true)
+	}
+	if !stalled {
+		logfile.retryPrimary(now)
+	}
+
+	rest := entries
+	if logfile.auditkey != nil {
+		rest = make([][]byte, len(entries))
+		chain := logfile.chain
+		for i, entry := range entries {
+			rest[i], chain = logfile.chainLines(chain, entry)
+		}
+	}
+	for len(rest) > 0 {
+		count := len(rest)
+		if !logfile.degraded {
+			//批量写入的日志超过剩余空间时按条拆分到下一个文件
+			if count = logfile.fits(rest); count == 0 {
+				logfile.rotate()
+				continue
 			}
-			logfile.file = file
-			logfile.filesize = 0
-			if err := oldfile.Close(); err != nil {
-				stdlog.Println("close file error: ", err)
+		}
+		chunk := bytes.Join(rest[:count], nil)
+		file := logfile.file
+		m, err := logfile.writeFile(file, chunk, count)
+		if isStall(err) {
+			if logfile.watchdog.policy != StallFallback {
+				//StallWait返回卡住或超时的错误；StallDrop时卡住的内容完成后仍会写入，只丢弃之后的日志
+				if logfile.watchdog.policy == StallDrop {
+					m, err = logfile.dropStalled(rest[count:])
+					m += len(chunk)
+				}
+				if n += m; n > total {
+					n = total
+				}
+				return n, err
 			}
+			//卡住的文件由stalled在写入完成后关闭，备用目录也卡住时切换到stderr
+			logfile.abandon(file, err)
+			m, err = logfile.file.Write(chunk)
+		} else if err != nil {
+			atomic.AddUint64(&logfile.stats.errors, 1)
+		}
+		if err != nil && !logfile.degraded {
+			logfile.degrade(fmt.Errorf("write log file %s error: %s", file.Name(), err))
+			m, err = logfile.file.Write(chunk)
+		}
+		n += m
+		atomic.AddUint64(&logfile.stats.bytes, uint64(m))
+		atomic.AddInt64(&logfile.filesize, int64(m)+logfile.overhead(m))
+		logfile.record(chunk[:m], completeEntries(rest[:count], m), now)
+		if err != nil {
+			e = err
+			break
 		}
-		logfile.lock.Unlock()
+		rest = rest[count:]
+	}
+	atomic.StoreInt64(&logfile.lastwrite, now.UnixNano())
+	if e == nil && logfile.needSync(entries...) {
+		if err := logfile.syncFile(logfile.file); isStall(err) {
+			logfile.abandon(logfile.file, err)
+		} else if err != nil {
+			stdlog.Println("sync file error: ", err)
+		}
+	}
+	//审计模式追加了hmac，返回调用方数据的长度
+	if n > total {
+		n = total
 	}
-	atomic.AddInt64(&logfile.filesize,int64(len(data)))
-	n, e = logfile.file.Write(data)
 	return n, e
 }
 
-func openFile(logfile LogFile) (*os.File, error) {
+//fits 返回entries中能写入当前文件而不超过maxsize、maxlines的日志条数，返回0表示需要先切分
+//当前文件为空时至少返回一条，单条日志超过maxsize时独占一个文件，当前文件不能追加时返回0
+func (logfile *LogFile) fits(entries [][]byte) int {
+	if logfile.sealed {
+		return 0
+	}
+	space := logfile.maxsize*1024*1024 - logfile.footerSpace() - atomic.LoadInt64(&logfile.filesize)
+	count := int64(len(entries))
+	if logfile.maxlines > 0 && logfile.maxlines-logfile.curlines < count {
+		count = logfile.maxlines - logfile.curlines
+	}
+	size := 0
+	for i := 0; int64(i) < count; i++ {
+		size += len(entries[i])
+		if int64(size)+logfile.overhead(size) > space {
+			if i == 0 && logfile.empty() {
+				return 1
+			}
+			return i
+		}
+	}
+	if count < 0 {
+		return 0
+	}
+	return int(count)
+}
+
+//empty 当前文件是否没有日志(header除外)，加密文件按行数判断，调用前需持有lock
+func (logfile *LogFile) empty() bool {
+	if _, ok := logfile.file.(*cryptFile); ok {
+		return logfile.curlines == 0
+	}
+	return atomic.LoadInt64(&logfile.filesize) <= logfile.headsize && logfile.curlines == 0
+}
+
+//overhead 写入n字节时加密增加的长度，调用前需持有lock
+func (logfile *LogFile) overhead(n int) int64 {
+	if c, ok := logfile.file.(*cryptFile); ok {
+		return c.overhead(n)
+	}
+	return 0
+}
+
+//full 当前文件是否已达到大小或行数上限，空文件不视为写满，调用前需持有lock
+func (logfile *LogFile) full() bool {
+	if logfile.sealed {
+		return true
+	}
+	if logfile.empty() {
+		return false
+	}
+	if logfile.maxlines > 0 && logfile.curlines >= logfile.maxlines {
+		return true
+	}
+	return atomic.LoadInt64(&logfile.filesize) >= logfile.maxsize*1024*1024-logfile.footerSpace()
+}
+
+//rotate 按大小或行数切分到下一个序号的文件，调用前需持有lock
+func (logfile *LogFile) rotate() {
+	logfile.curindex++
+	file, err := logfile.open(*logfile)
+	if err != nil {
+		logfile.degrade(errors.New("write file open log file error: " + err.Error()))
+		return
+	}
+	logfile.rotateTo(file, true)
+}
+
+//setWindow 根据当前时间计算所属的时间窗口，调用前需持有lock
+func (logfile *LogFile) setWindow(now time.Time) {
+	date, daystart, dayend := businessDay(logfile.dateprovider, now)
+	logfile.curdate = date.Format(defaultDateFormat)
+	if logfile.interval <= 0 {
+		logfile.curwindow = ""
+		logfile.windowend = dayend
+		return
+	}
+	step := time.Duration(logfile.interval) * time.Minute
+	start := daystart.Add(now.Sub(daystart) / step * step)
+	end := start.Add(step)
+	if end.After(dayend) {
+		end = dayend
+	}
+	logfile.curwindow = start.Format("1504")
+	logfile.windowend = end
+}
+
+//rotateTo 切换到新打开的文件，zip为true时压缩旧文件，调用前需持有lock
+func (logfile *LogFile) rotateTo(file File, zip bool) {
+	oldfile := logfile.file
+	logfile.finish(oldfile, file.Name())
+	old := logfile.segment()
+	logfile.file = file
+	logfile.filesize = 0
+	if fInfo, err := file.Stat(); err == nil {
+		logfile.filesize = fInfo.Size()
+	}
+	logfile.scanSegment(file)
+	logfile.segstart = logfile.clock.Now()
+	logfile.emit(old, logfile.segment())
+	logfile.updateLink()
+	if zip {
+		atomic.AddUint64(&logfile.stats.rotations, 1)
+	}
+	//卡住的旧文件由stalled在完成后关闭，不压缩
+	if oldfile != nil && logfile.closeFile(oldfile) && zip {
+		logfile.compress(oldfile.Name())
+	}
+}
+
+//rollWindow 时间窗口结束，关闭旧文件并打开新窗口的第一个文件，zip为true时压缩旧文件，调用前需持有lock
+func (logfile *LogFile) rollWindow(now time.Time, zip bool) {
+	old := logfile.segment()
+	var zipfile string
+	if logfile.file != nil {
+		atomic.AddUint64(&logfile.stats.rotations, 1)
+		logfile.finish(logfile.file, "")
+		//降级输出的文件不在日志目录下，不压缩
+		if logfile.closeFile(logfile.file) && zip && !logfile.degraded {
+			zipfile = logfile.file.Name()
+		}
+		logfile.file = nil
+	}
+	logfile.setWindow(now)
+	logfile.curindex = 0
+	logfile.filesize = 0
+	logfile.curlines = 0
+	logfile.setFile()
+	logfile.emit(old, logfile.segment())
+	if zipfile != "" {
+		logfile.compress(zipfile)
+	}
+}
+
+//segmentFile 当前curindex对应的日志文件路径
+func segmentFile(logfile LogFile) (string, error) {
 	if logfile.filepath == "" || logfile.backendname == "" || logfile.servicename == "" || logfile.curdate == "" {
-		return nil, fmt.Errorf("filename can't empty")
+		return "", fmt.Errorf("filename can't empty")
+	}
+	return logfile.naming.render(logfile.filepath, segmentName{
+		backend: logfile.backendname,
+		service: logfile.servicename,
+		date:    logfile.curdate,
+		time:    logfile.curwindow,
+		index:   logfile.curindex,
+	}), nil
+}
+
+func openFile(logfile LogFile) (File, error) {
+	fpath, err := segmentFile(logfile)
+	if err != nil {
+		return nil, err
 	}
-	fpath := logfile.filepath + "\\" + logfile.backendname + "." + logfile.servicename + "." +
-		logfile.curdate + "." + fmt.Sprintf("%06d", logfile.curindex)
-	file, err := os.OpenFile(fpath, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_SYNC, 0664)
+	//按日期分目录时自动创建
+	if err := logfile.fs.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return nil, fmt.Errorf("write file create log dir %s error: %s", filepath.Dir(fpath), err)
+	}
+	flag := os.O_WRONLY | os.O_APPEND | os.O_CREATE
+	if logfile.syncpolicy == SyncAlways {
+		flag |= os.O_SYNC
+	}
+	file, err := logfile.fs.OpenFile(fpath, flag, 0664)
 	if err != nil {
 		return nil, fmt.Errorf("write file open log file %s error: %s", fpath, err)
 	}
+	fInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("write file stat log file %s error: %s", fpath, err)
+	}
+	if logfile.keys != nil {
+		encrypted, err := encryptFile(file, logfile.keys)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("encrypt log file %s error: %s", fpath, err)
+		}
+		file = encrypted
+	}
+	//新文件首行写入header
+	if logfile.meta && fInfo.Size() == 0 {
+		if _, err := file.Write(header(logfile)); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("write log header %s error: %s", fpath, err)
+		}
+	}
 	return file, nil
 }
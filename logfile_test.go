@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+//newTestLogFile 写入MemFS的LogFile
+func newTestLogFile(fs *MemFS, clock Clock) *LogFile {
+	logfile := NewLogFile()
+	logfile.SetFileSystem(fs)
+	if clock != nil {
+		logfile.SetClock(clock)
+		logfile.SetCurDate(clock.Now().Format(defaultDateFormat))
+	}
+	logfile.SetFilePath("/logs")
+	logfile.SetBackendName("rpc")
+	logfile.SetServiceName("svc")
+	logfile.SetSyncPolicy(SyncNever, 0)
+	return logfile
+}
+
+//readSegments 按文件名排序读取目录下所有文件
+func readSegments(t *testing.T, fs *MemFS, dir string) (names []string, contents [][]byte) {
+	t.Helper()
+	infos, err := fs.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if !info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		file, err := fs.OpenFile(path.Join(dir, name), os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, data)
+	}
+	return names, contents
+}
+
+func TestConcurrentRotation(t *testing.T) {
+	const (
+		writers = 16
+		lines   = 2000
+		linelen = 100
+	)
+	fs := NewMemFS(nil)
+	logfile := newTestLogFile(fs, nil)
+	logfile.SetMaxSize(1)
+
+	var wg sync.WaitGroup
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < lines; i++ {
+				line := fmt.Sprintf("[LOGINF] g=%02d i=%05d ", g, i)
+				line += string(bytes.Repeat([]byte{'x'}, linelen-len(line)-1)) + "\n"
+				if n, err := logfile.Write([]byte(line)); err != nil || n != linelen {
+					t.Errorf("write %d %d: n=%d err=%v", g, i, n, err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if err := logfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names, contents := readSegments(t, fs, "/logs")
+	if len(names) < 2 {
+		t.Fatalf("expected rotation, got %v", names)
+	}
+	seen := make(map[string]bool)
+	var total int
+	for i, data := range contents {
+		if len(data) > 1024*1024 {
+			t.Errorf("%s: %d bytes exceeds maxsize", names[i], len(data))
+		}
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			t.Errorf("%s: ends with a partial line", names[i])
+		}
+		total += len(data)
+		for _, line := range bytes.SplitAfter(data, []byte{'\n'}) {
+			if len(line) == 0 {
+				continue
+			}
+			if len(line) != linelen {
+				t.Fatalf("%s: torn line %q", names[i], line)
+			}
+			key := string(line[:22])
+			if seen[key] {
+				t.Fatalf("%s: duplicate line %q", names[i], key)
+			}
+			seen[key] = true
+		}
+	}
+	if total != writers*lines*linelen || len(seen) != writers*lines {
+		t.Fatalf("lost data: %d bytes, %d lines", total, len(seen))
+	}
+}
+
+func TestTimeRollover(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 2, 22, 59, 59, 0, time.Local))
+	fs := NewMemFS(clock)
+	logfile := newTestLogFile(fs, clock)
+	logfile.SetRotateInterval(60)
+
+	logfile.Write([]byte("[LOGINF] a\n"))
+	clock.Advance(time.Second)
+	logfile.Write([]byte("[LOGINF] b\n"))
+	logfile.Write([]byte("[LOGINF] c\n"))
+	clock.Advance(time.Hour)
+	logfile.Write([]byte("[LOGINF] d\n"))
+	logfile.Close()
+
+	names, contents := readSegments(t, fs, "/logs")
+	want := []string{"rpc.svc.20240102.2200.000000", "rpc.svc.20240102.2300.000000", "rpc.svc.20240103.0000.000000"}
+	if fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Fatalf("segments %v, want %v", names, want)
+	}
+	for i, data := range []string{"[LOGINF] a\n", "[LOGINF] b\n[LOGINF] c\n", "[LOGINF] d\n"} {
+		if string(contents[i]) != data {
+			t.Errorf("%s: %q, want %q", names[i], contents[i], data)
+		}
+	}
+}
+
+func TestDailyRolloverResetsIndex(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 2, 23, 0, 0, 0, time.Local))
+	fs := NewMemFS(clock)
+	logfile := newTestLogFile(fs, clock)
+	logfile.SetMaxSize(1)
+
+	line := append(bytes.Repeat([]byte{'x'}, 512*1024-1), '\n')
+	for i := 0; i < 3; i++ {
+		logfile.Write(line)
+	}
+	clock.Advance(2 * time.Hour)
+	logfile.Write([]byte("[LOGINF] next day\n"))
+	logfile.Close()
+
+	names, _ := readSegments(t, fs, "/logs")
+	want := []string{"rpc.svc.20240102.000000", "rpc.svc.20240102.000001", "rpc.svc.20240103.000000"}
+	if fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Fatalf("segments %v, want %v", names, want)
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	fs := NewMemFS(nil)
+	logfile := newTestLogFile(fs, nil)
+	logfile.Write([]byte("[LOGINF] a\n"))
+	if err := logfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := logfile.Write([]byte("[LOGINF] b\n")); n != 0 || err != os.ErrClosed {
+		t.Fatalf("write after close: n=%d err=%v", n, err)
+	}
+	names, contents := readSegments(t, fs, "/logs")
+	if len(names) != 1 || string(contents[0]) != "[LOGINF] a\n" {
+		t.Fatalf("segments %v %q", names, contents)
+	}
+}
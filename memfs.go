@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//MemFS 内存文件系统，用于测试切分、清理逻辑，可通过SetFault注入ENOSPC、EACCES等错误
+type MemFS struct {
+	lock  sync.Mutex
+	clock Clock
+	files map[string]*memNode
+	dirs  map[string]time.Time
+	fault func(op string, name string) error
+}
+
+//memNode 文件内容，rename后已打开的句柄仍然写入同一个节点
+type memNode struct {
+	data    []byte
+	modtime time.Time
+}
+
+//NewMemFS clock用于记录文件修改时间，为nil时使用系统时间
+func NewMemFS(clock Clock) *MemFS {
+	if clock == nil {
+		clock = SystemClock
+	}
+	return &MemFS{
+		clock: clock,
+		files: make(map[string]*memNode),
+		dirs:  make(map[string]time.Time),
+	}
+}
+
+//SetFault 设置错误注入函数，op为open、write、stat、mkdir、rename、remove、readdir、sync，返回非nil时操作失败，阻塞时操作卡住
+func (fs *MemFS) SetFault(fault func(op string, name string) error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.fault = fault
+}
+
+//check 在lock之外调用注入函数，注入函数可以阻塞以模拟卡住的磁盘，不影响其他文件的操作
+func (fs *MemFS) check(op string, name string) error {
+	fs.lock.Lock()
+	fault := fs.fault
+	fs.lock.Unlock()
+	if fault == nil {
+		return nil
+	}
+	if err := fault(op, name); err != nil {
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+//isDir 调用前需持有lock
+func (fs *MemFS) isDir(name string) bool {
+	if _, ok := fs.dirs[name]; ok {
+		return true
+	}
+	return filepath.Dir(name) == name
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	if err := fs.check("open", name); err != nil {
+		return nil, err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.isDir(name) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	node, ok := fs.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		if !fs.isDir(filepath.Dir(name)) {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		node = &memNode{modtime: fs.clock.Now()}
+		fs.files[name] = node
+	}
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		node.data = nil
+		node.modtime = fs.clock.Now()
+	}
+	return &memFile{fs: fs, name: name, node: node, flag: flag}, nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	if err := fs.check("stat", name); err != nil {
+		return nil, err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if node, ok := fs.files[name]; ok {
+		return memFileInfo{name: filepath.Base(name), size: int64(len(node.data)), modtime: node.modtime}, nil
+	}
+	if fs.isDir(name) {
+		return memFileInfo{name: filepath.Base(name), modtime: fs.dirs[name], dir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	path = filepath.Clean(path)
+	if err := fs.check("mkdir", path); err != nil {
+		return err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for dir := path; !fs.isDir(dir); dir = filepath.Dir(dir) {
+		if _, ok := fs.files[dir]; ok {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+		}
+		fs.dirs[dir] = fs.clock.Now()
+	}
+	return nil
+}
+
+func (fs *MemFS) Rename(oldpath string, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	if err := fs.check("rename", oldpath); err != nil {
+		return err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, ok := fs.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if !fs.isDir(filepath.Dir(newpath)) || fs.isDir(newpath) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrInvalid}
+	}
+	delete(fs.files, oldpath)
+	fs.files[newpath] = node
+	return nil
+}
+
+//Remove 删除文件或空目录
+func (fs *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	if err := fs.check("remove", name); err != nil {
+		return err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if _, ok := fs.files[name]; ok {
+		delete(fs.files, name)
+		return nil
+	}
+	if _, ok := fs.dirs[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if len(fs.children(name)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	delete(fs.dirs, name)
+	return nil
+}
+
+func (fs *MemFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	dirname = filepath.Clean(dirname)
+	if err := fs.check("readdir", dirname); err != nil {
+		return nil, err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if !fs.isDir(dirname) {
+		return nil, &os.PathError{Op: "open", Path: dirname, Err: os.ErrNotExist}
+	}
+	return fs.children(dirname), nil
+}
+
+//children 目录下的文件和子目录，按名称排序，调用前需持有lock
+func (fs *MemFS) children(dir string) []os.FileInfo {
+	var infos []os.FileInfo
+	for name, node := range fs.files {
+		if filepath.Dir(name) == dir {
+			infos = append(infos, memFileInfo{name: filepath.Base(name), size: int64(len(node.data)), modtime: node.modtime})
+		}
+	}
+	for name, modtime := range fs.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			infos = append(infos, memFileInfo{name: filepath.Base(name), modtime: modtime, dir: true})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos
+}
+
+//memFile MemFS打开的文件句柄
+type memFile struct {
+	fs     *MemFS
+	name   string
+	node   *memNode
+	flag   int
+	offset int64
+	closed bool
+}
+
+func (file *memFile) Name() string {
+	return file.name
+}
+
+func (file *memFile) Read(p []byte) (int, error) {
+	file.fs.lock.Lock()
+	defer file.fs.lock.Unlock()
+	if file.closed {
+		return 0, &os.PathError{Op: "read", Path: file.name, Err: os.ErrClosed}
+	}
+	if file.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: "read", Path: file.name, Err: os.ErrPermission}
+	}
+	if file.offset >= int64(len(file.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, file.node.data[file.offset:])
+	file.offset += int64(n)
+	return n, nil
+}
+
+func (file *memFile) ReadAt(p []byte, off int64) (int, error) {
+	file.fs.lock.Lock()
+	defer file.fs.lock.Unlock()
+	if file.closed {
+		return 0, &os.PathError{Op: "read", Path: file.name, Err: os.ErrClosed}
+	}
+	if file.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: "read", Path: file.name, Err: os.ErrPermission}
+	}
+	if off >= int64(len(file.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, file.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (file *memFile) Write(p []byte) (int, error) {
+	if err := file.fs.check("write", file.name); err != nil {
+		return 0, err
+	}
+	file.fs.lock.Lock()
+	defer file.fs.lock.Unlock()
+	if file.closed {
+		return 0, &os.PathError{Op: "write", Path: file.name, Err: os.ErrClosed}
+	}
+	if file.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: file.name, Err: os.ErrPermission}
+	}
+	node := file.node
+	if file.flag&os.O_APPEND != 0 {
+		file.offset = int64(len(node.data))
+	}
+	if gap := file.offset - int64(len(node.data)); gap > 0 {
+		node.data = append(node.data, make([]byte, gap)...)
+	}
+	end := file.offset + int64(len(p))
+	if end > int64(len(node.data)) {
+		node.data = append(node.data[:file.offset], p...)
+	} else {
+		copy(node.data[file.offset:], p)
+	}
+	file.offset = end
+	node.modtime = file.fs.clock.Now()
+	return len(p), nil
+}
+
+func (file *memFile) Stat() (os.FileInfo, error) {
+	file.fs.lock.Lock()
+	defer file.fs.lock.Unlock()
+	if file.closed {
+		return nil, &os.PathError{Op: "stat", Path: file.name, Err: os.ErrClosed}
+	}
+	return memFileInfo{name: filepath.Base(file.name), size: int64(len(file.node.data)), modtime: file.node.modtime}, nil
+}
+
+func (file *memFile) Sync() error {
+	if err := file.fs.check("sync", file.name); err != nil {
+		return err
+	}
+	file.fs.lock.Lock()
+	defer file.fs.lock.Unlock()
+	if file.closed {
+		return &os.PathError{Op: "sync", Path: file.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (file *memFile) Close() error {
+	file.fs.lock.Lock()
+	defer file.fs.lock.Unlock()
+	if file.closed {
+		return &os.PathError{Op: "close", Path: file.name, Err: os.ErrClosed}
+	}
+	file.closed = true
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modtime time.Time
+	dir     bool
+}
+
+func (info memFileInfo) Name() string       { return info.name }
+func (info memFileInfo) Size() int64        { return info.size }
+func (info memFileInfo) ModTime() time.Time { return info.modtime }
+func (info memFileInfo) IsDir() bool        { return info.dir }
+func (info memFileInfo) Sys() interface{}   { return nil }
+
+func (info memFileInfo) Mode() os.FileMode {
+	if info.dir {
+		return os.ModeDir | 0755
+	}
+	return 0664
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	metaFormat    = "logrus-extends"
+	metaVersion   = 1
+	headerPrefix  = "#LOGHDR "
+	footerPrefix  = "#LOGEND "
+	footerReserve = 256 //footer最大长度(含审计hmac、加密帧)，按大小切分时预留
+)
+
+//SetHeaderFooter 开启后每个新日志文件首行写入header，切分时在旧文件末尾写入footer
+//header: #LOGHDR format=logrus-extends version=1 host= pid= backend= service= date= logfield= prev= opened= [chain=]
+//footer: #LOGEND entries= first= last= crc32=，crc32为footer之前所有内容的校验和，审计模式下末尾追加hmac(不推进链)
+//logfield为Formatter的日志域控制(同配置文件logfield)；Close时不写footer，重启后继续写入同一文件；多进程共享模式下不写footer
+func (logfile *LogFile) SetHeaderFooter(enable bool, logfield string) {
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	logfile.meta = enable
+	logfile.logfield = logfield
+	if logfile.file != nil {
+		logfile.scanSegment(logfile.file)
+	}
+}
+
+//header 新日志文件的首行，prev为切分前正在写入的文件，重启后为上一个序号的文件
+func header(logfile LogFile) []byte {
+	prev := logfile.prevseg
+	if logfile.file != nil && !isStderr(logfile.file) {
+		prev = filepath.Base(logfile.file.Name())
+	} else if prev == "" && logfile.curindex > 0 {
+		logfile.curindex--
+		if fpath, err := segmentFile(logfile); err == nil {
+			prev = filepath.Base(fpath)
+		}
+	}
+	if prev == "" {
+		prev = "-"
+	}
+	logfield := logfile.logfield
+	if logfile.logfield == "" {
+		logfield = "-"
+	}
+	line := fmt.Sprintf("%sformat=%s version=%d host=%s pid=%d backend=%s service=%s date=%s logfield=%s prev=%s opened=%s",
+		headerPrefix, metaFormat, metaVersion, hostname, os.Getpid(), logfile.backendname, logfile.servicename,
+		logfile.curdate, logfield, prev, logfile.clock.Now().Format(time.RFC3339Nano))
+	if logfile.auditkey != nil {
+		line += " " + chainField + chainHex(logfile.chain)
+	}
+	return []byte(line + "\n")
+}
+
+//footerSpace 按大小切分时为footer预留的空间，调用前需持有lock
+func (logfile *LogFile) footerSpace() int64 {
+	if !logfile.meta || logfile.shared {
+		return 0
+	}
+	return footerReserve
+}
+
+//finish 关闭前在旧文件末尾写入footer并记录文件名，next为将要写入的文件，调用前需持有lock
+func (logfile *LogFile) finish(file File, next string) {
+	if file == nil || isStderr(file) {
+		return
+	}
+	if logfile.meta && !logfile.shared && !logfile.degraded && file.Name() != next {
+		footer := fmt.Sprintf("%sentries=%d first=%s last=%s crc32=%08x", footerPrefix, logfile.curlines,
+			metaTime(logfile.first), metaTime(logfile.last), logfile.crc)
+		if logfile.auditkey != nil {
+			//hmac绑定到最后一行，footer不能被伪造或移动
+			footer += auditField + chainHex(chainSum(logfile.auditkey, logfile.chain, []byte(footer)))
+		}
+		if _, err := logfile.writeFile(file, []byte(footer+"\n"), 0); err != nil {
+			stdlog.Println("write log footer error: ", err)
+		}
+	}
+	logfile.prevseg = filepath.Base(file.Name())
+}
+
+func metaTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+//record 记录写入的entries条日志，用于按条切分、footer和审计链，调用前需持有lock
+func (logfile *LogFile) record(data []byte, entries int, now time.Time) {
+	logfile.curlines += int64(entries)
+	if logfile.auditkey != nil {
+		last := bytes.TrimSuffix(data, []byte{'\n'})
+		if idx := bytes.LastIndexByte(last, '\n'); idx >= 0 {
+			last = last[idx+1:]
+		}
+		if _, sum, ok := splitAudit(last); ok {
+			logfile.chain = sum
+		}
+	}
+	if !logfile.meta {
+		return
+	}
+	logfile.crc = crc32.Update(logfile.crc, crc32.IEEETable, data)
+	if logfile.first.IsZero() {
+		logfile.first = now
+	}
+	logfile.last = now
+}
+
+//isMetaLine 是否为header、footer或不完整行的标记
+func isMetaLine(line []byte) bool {
+	return bytes.HasPrefix(line, []byte(headerPrefix)) || bytes.HasPrefix(line, []byte(footerPrefix)) ||
+		bytes.HasPrefix(line, []byte(tornPrefix))
+}
+
+//scanSegment 读取已存在的日志文件，统计日志行数、校验和及首末条日志时间，末尾有不完整的行时先恢复
+//未开启按行切分、header/footer和加密时只检查文件是否可以追加，调用前需持有lock
+func (logfile *LogFile) scanSegment(file File) {
+	logfile.curlines, logfile.headsize, logfile.crc = 0, 0, 0
+	logfile.first, logfile.last = time.Time{}, time.Time{}
+	logfile.sealed = false
+	if file == nil || isStderr(file) {
+		return
+	}
+	//打开后开启、关闭加密或更换了密钥
+	if logfile.encryptionChanged(file) {
+		logfile.sealed = true
+		return
+	}
+	fInfo, err := file.Stat()
+	if err != nil || fInfo.Size() == 0 {
+		return
+	}
+	src, err := logfile.fs.OpenFile(file.Name(), os.O_RDONLY, 0)
+	if err != nil {
+		stdlog.Println("scan log file error: ", err)
+		return
+	}
+	defer src.Close()
+
+	r := bufio.NewReaderSize(src, 64*1024)
+	//加密状态或密钥与当前文件不一致时不能追加
+	keyid, encrypted := encryptedKeyID(r)
+	if c, ok := file.(*cryptFile); encrypted != ok || (ok && keyid != c.keyid) {
+		logfile.sealed = true
+		return
+	}
+	if logfile.maxlines <= 0 && !logfile.meta && !encrypted {
+		logfile.recoverTail(file, src, fInfo.Size())
+		return
+	}
+	var dr *decryptReader
+	if encrypted {
+		dr = newDecryptReader(r, logfile.keys, segmentBase(file.Name()))
+		r = bufio.NewReaderSize(dr, 64*1024)
+	}
+	crc := crc32.NewIEEE()
+	linestart, meta, torn := true, false, false
+	for {
+		line, err := r.ReadSlice('\n')
+		crc.Write(line)
+		if linestart && len(line) > 0 {
+			meta = isMetaLine(line)
+			torn = bytes.HasPrefix(line, []byte(tornPrefix))
+			//Formatter转义了日志内容中的换行，每行为一条日志，末尾不完整的行同样计数
+			if !meta {
+				logfile.curlines++
+			}
+			if bytes.HasPrefix(line, []byte(headerPrefix)) && logfile.headsize == 0 && logfile.curlines == 0 {
+				logfile.headsize = int64(len(line))
+				logfile.first = headerOpened(string(line))
+				if sum, ok := headerChain(string(line)); ok && logfile.auditkey != nil {
+					logfile.chain = sum
+				}
+			}
+		}
+		//不完整行的标记推进链，header、footer不推进
+		if err == nil && (!meta || torn) {
+			if _, sum, ok := splitAudit(bytes.TrimSuffix(line, []byte{'\n'})); ok && logfile.auditkey != nil {
+				logfile.chain = sum
+			}
+		}
+		linestart = err == nil
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				//末尾帧不完整或无法解密，不再追加
+				stdlog.Println("scan log file error: ", err)
+				logfile.sealed = encrypted
+			}
+			break
+		}
+	}
+	logfile.crc = crc.Sum32()
+	//追加的帧从已有帧数继续编号，旧版本没有附加数据的文件不再追加
+	if c, ok := file.(*cryptFile); ok && !logfile.sealed {
+		c.seq = dr.seq
+		logfile.sealed = dr.legacy
+	}
+	//链已恢复到最后一个完整的行，标记行的hmac串联不完整的行
+	if !encrypted {
+		logfile.recoverTail(file, src, fInfo.Size())
+	}
+	if logfile.curlines > 0 {
+		logfile.last = fInfo.ModTime()
+		if logfile.first.IsZero() {
+			logfile.first = fInfo.ModTime()
+		}
+	} else {
+		logfile.first = time.Time{}
+	}
+}
+
+//headerOpened 解析header中的opened
+func headerOpened(line string) time.Time {
+	for _, field := range strings.Fields(line) {
+		if strings.HasPrefix(field, "opened=") {
+			t, _ := time.Parse(time.RFC3339Nano, strings.TrimPrefix(field, "opened="))
+			return t
+		}
+	}
+	return time.Time{}
+}
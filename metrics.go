@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const metricsPrefix = "logrus_extends_"
+
+//latencyBuckets 耗时直方图的桶上限(秒)
+var latencyBuckets = [...]float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+//histogram 耗时直方图，无锁记录
+type histogram struct {
+	counts [len(latencyBuckets) + 1]uint64 //最后一个桶为超过5秒
+	count  uint64
+	sum    int64 //纳秒
+}
+
+func (h *histogram) observe(d time.Duration) {
+	idx := sort.SearchFloat64s(latencyBuckets[:], d.Seconds())
+	atomic.AddUint64(&h.counts[idx], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+//since 记录从start到现在的耗时，用于defer
+func (h *histogram) since(start time.Time) {
+	h.observe(time.Since(start))
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{
+		Bounds: latencyBuckets[:],
+		Counts: make([]uint64, len(latencyBuckets)),
+		Count:  atomic.LoadUint64(&h.count),
+		Sum:    time.Duration(atomic.LoadInt64(&h.sum)).Seconds(),
+	}
+	var total uint64
+	for i := range s.Counts {
+		total += atomic.LoadUint64(&h.counts[i])
+		s.Counts[i] = total
+	}
+	return s
+}
+
+//Histogram 耗时分布，Counts[i]为耗时不超过Bounds[i]秒的次数(累计)，Sum为总耗时(秒)
+type Histogram struct {
+	Bounds []float64
+	Counts []uint64
+	Count  uint64
+	Sum    float64
+}
+
+//metricsID 每个LogFile、AsyncWriter的指标编号，同名实例(如多次InitLog)的指标不重复
+var metricsID uint64
+
+func nextMetricsID() uint64 {
+	return atomic.AddUint64(&metricsID, 1)
+}
+
+//fileStats LogFile的写入指标
+type fileStats struct {
+	id        uint64
+	name      atomic.Value //backend.service
+	bytes     uint64
+	rotations uint64
+	errors    uint64
+	stalls    uint64
+	stalled   int32 //1：有写入卡住
+	dropped   uint64
+	write     histogram
+}
+
+//FileStats LogFile写入指标：写入字节数(含审计hmac)、切分次数、写入错误次数、Write耗时(含等待lock)，
+//写入卡住次数、当前是否卡住以及卡住期间丢弃的日志条数
+type FileStats struct {
+	ID           uint64
+	Name         string
+	Bytes        uint64
+	Rotations    uint64
+	WriteErrors  uint64
+	WriteLatency Histogram
+	Stalls       uint64
+	Stalled      bool
+	Dropped      uint64
+}
+
+//QueueStats AsyncWriter队列指标
+type QueueStats struct {
+	ID       uint64
+	Name     string
+	Depth    int
+	Capacity int
+	Dropped  uint64
+}
+
+//Snapshot 日志组件指标快照
+type Snapshot struct {
+	Entries       map[string]uint64 //Formatter按级别统计的日志条数
+	FormatLatency Histogram
+	HookErrors    uint64 //RpcHook格式化或写入失败次数
+	HookLatency   Histogram
+	Files         []FileStats
+	Queues        []QueueStats
+}
+
+//Formatter、RpcHook为所有实例汇总的指标
+var metrics struct {
+	entries [logrus.TraceLevel + 1]uint64
+	format  histogram
+	hookerr uint64
+	hook    histogram
+}
+
+//已创建的AsyncWriter，Close后移除
+var asyncwriters = struct {
+	sync.Mutex
+	m map[*AsyncWriter]struct{}
+}{m: make(map[*AsyncWriter]struct{})}
+
+//countEntry Formatter格式化一条日志后调用
+func countEntry(level logrus.Level, start time.Time) {
+	if level <= logrus.TraceLevel {
+		atomic.AddUint64(&metrics.entries[level], 1)
+	}
+	metrics.format.since(start)
+}
+
+//Stats LogFile的写入指标，不需要lock，写入阻塞时同样可以读取
+func (logfile *LogFile) Stats() FileStats {
+	name, _ := logfile.stats.name.Load().(string)
+	return FileStats{
+		ID:           logfile.stats.id,
+		Name:         name,
+		Bytes:        atomic.LoadUint64(&logfile.stats.bytes),
+		Rotations:    atomic.LoadUint64(&logfile.stats.rotations),
+		WriteErrors:  atomic.LoadUint64(&logfile.stats.errors),
+		WriteLatency: logfile.stats.write.snapshot(),
+		Stalls:       atomic.LoadUint64(&logfile.stats.stalls),
+		Stalled:      atomic.LoadInt32(&logfile.stats.stalled) != 0,
+		Dropped:      atomic.LoadUint64(&logfile.stats.dropped),
+	}
+}
+
+//setStatsName 调用前需持有lock
+func (logfile *LogFile) setStatsName() {
+	logfile.stats.name.Store(logfile.backendname + "." + logfile.servicename)
+}
+
+//Stats AsyncWriter队列长度、容量和丢弃条数
+func (w *AsyncWriter) Stats() QueueStats {
+	name := fmt.Sprintf("%T", w.writer)
+	if logfile, ok := w.writer.(*LogFile); ok {
+		name = logfile.Stats().Name
+	}
+	return QueueStats{ID: w.id, Name: name, Depth: w.QueueLen(), Capacity: w.capacity, Dropped: w.Dropped()}
+}
+
+//Stats 所有已打开的LogFile、AsyncWriter以及Formatter、RpcHook的指标快照
+func Stats() Snapshot {
+	s := Snapshot{
+		Entries:       make(map[string]uint64),
+		FormatLatency: metrics.format.snapshot(),
+		HookErrors:    atomic.LoadUint64(&metrics.hookerr),
+		HookLatency:   metrics.hook.snapshot(),
+	}
+	for _, level := range logrus.AllLevels {
+		s.Entries[level.String()] = atomic.LoadUint64(&metrics.entries[level])
+	}
+	logfiles.Lock()
+	for logfile := range logfiles.m {
+		s.Files = append(s.Files, logfile.Stats())
+	}
+	logfiles.Unlock()
+	sort.Slice(s.Files, func(i, j int) bool {
+		if s.Files[i].Name != s.Files[j].Name {
+			return s.Files[i].Name < s.Files[j].Name
+		}
+		return s.Files[i].ID < s.Files[j].ID
+	})
+	asyncwriters.Lock()
+	for w := range asyncwriters.m {
+		s.Queues = append(s.Queues, w.Stats())
+	}
+	asyncwriters.Unlock()
+	sort.Slice(s.Queues, func(i, j int) bool {
+		if s.Queues[i].Name != s.Queues[j].Name {
+			return s.Queues[i].Name < s.Queues[j].Name
+		}
+		return s.Queues[i].ID < s.Queues[j].ID
+	})
+	return s
+}
+
+//PublishExpvar 以name发布到expvar(/debug/vars)，重复发布忽略
+func PublishExpvar(name string) {
+	if expvar.Get(name) != nil {
+		return
+	}
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return Stats()
+	}))
+}
+
+//MetricsHandler 以Prometheus文本格式输出指标
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(prometheusText(Stats()))
+	})
+}
+
+//metricsServer 进程内唯一的指标服务，重复InitLog时复用
+var metricsServer struct {
+	sync.Mutex
+	addr string
+	ln   net.Listener
+}
+
+//ServeMetrics 在addr监听，/metrics输出Prometheus格式指标，/debug/vars输出expvar
+//已在addr监听时直接返回，地址变化时关闭之前的监听
+func ServeMetrics(addr string) error {
+	PublishExpvar(metaFormat)
+	metricsServer.Lock()
+	defer metricsServer.Unlock()
+	if metricsServer.ln != nil && metricsServer.addr == addr {
+		return nil
+	}
+	stopMetrics()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	mux.Handle("/debug/vars", expvar.Handler())
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen metrics %s error: %s", addr, err)
+	}
+	metricsServer.addr, metricsServer.ln = addr, ln
+	go func() {
+		err := http.Serve(ln, mux)
+		metricsServer.Lock()
+		defer metricsServer.Unlock()
+		//主动关闭的监听不输出错误
+		if metricsServer.ln == ln {
+			stdlog.Println("serve metrics error: ", err)
+			metricsServer.ln = nil
+		}
+	}()
+	return nil
+}
+
+//StopMetrics 关闭ServeMetrics的监听
+func StopMetrics() {
+	metricsServer.Lock()
+	defer metricsServer.Unlock()
+	stopMetrics()
+}
+
+//stopMetrics 调用前需持有metricsServer的锁
+func stopMetrics() {
+	if metricsServer.ln != nil {
+		metricsServer.ln.Close()
+		metricsServer.addr, metricsServer.ln = "", nil
+	}
+}
+
+//prometheusText 按Prometheus文本格式输出快照
+func prometheusText(s Snapshot) []byte {
+	var b bytes.Buffer
+	metricHeader(&b, "entries_total", "counter", "Log entries formatted, by level.")
+	for _, level := range logrus.AllLevels {
+		fmt.Fprintf(&b, "%sentries_total{level=%q} %d\n", metricsPrefix, level.String(), s.Entries[level.String()])
+	}
+	metricHeader(&b, "format_seconds", "histogram", "Formatter latency.")
+	writeHistogram(&b, "format_seconds", "", s.FormatLatency)
+	metricHeader(&b, "hook_errors_total", "counter", "RpcHook format or write errors.")
+	fmt.Fprintf(&b, "%shook_errors_total %d\n", metricsPrefix, s.HookErrors)
+	metricHeader(&b, "hook_seconds", "histogram", "RpcHook Fire latency.")
+	writeHistogram(&b, "hook_seconds", "", s.HookLatency)
+
+	metricHeader(&b, "written_bytes_total", "counter", "Bytes written to log files.")
+	for _, f := range s.Files {
+		fmt.Fprintf(&b, "%swritten_bytes_total{%s} %d\n", metricsPrefix, f.labels(), f.Bytes)
+	}
+	metricHeader(&b, "rotations_total", "counter", "Log file rotations by size, lines or time.")
+	for _, f := range s.Files {
+		fmt.Fprintf(&b, "%srotations_total{%s} %d\n", metricsPrefix, f.labels(), f.Rotations)
+	}
+	metricHeader(&b, "write_errors_total", "counter", "Failed writes to log files.")
+	for _, f := range s.Files {
+		fmt.Fprintf(&b, "%swrite_errors_total{%s} %d\n", metricsPrefix, f.labels(), f.WriteErrors)
+	}
+	metricHeader(&b, "write_seconds", "histogram", "LogFile Write latency, including lock wait.")
+	for _, f := range s.Files {
+		writeHistogram(&b, "write_seconds", f.labels(), f.WriteLatency)
+	}
+	metricHeader(&b, "stalls_total", "counter", "Log file writes that did not finish within the watchdog threshold.")
+	for _, f := range s.Files {
+		fmt.Fprintf(&b, "%sstalls_total{%s} %d\n", metricsPrefix, f.labels(), f.Stalls)
+	}
+	metricHeader(&b, "stalled", "gauge", "1 while a log file write is stalled.")
+	for _, f := range s.Files {
+		stalled := 0
+		if f.Stalled {
+			stalled = 1
+		}
+		fmt.Fprintf(&b, "%sstalled{%s} %d\n", metricsPrefix, f.labels(), stalled)
+	}
+	metricHeader(&b, "stall_dropped_total", "counter", "Entries dropped while a log file write was stalled.")
+	for _, f := range s.Files {
+		fmt.Fprintf(&b, "%sstall_dropped_total{%s} %d\n", metricsPrefix, f.labels(), f.Dropped)
+	}
+
+	metricHeader(&b, "dropped_total", "counter", "Entries dropped by async queues.")
+	for _, q := range s.Queues {
+		fmt.Fprintf(&b, "%sdropped_total{%s} %d\n", metricsPrefix, q.labels(), q.Dropped)
+	}
+	metricHeader(&b, "queue_depth", "gauge", "Entries waiting in async queues.")
+	for _, q := range s.Queues {
+		fmt.Fprintf(&b, "%squeue_depth{%s} %d\n", metricsPrefix, q.labels(), q.Depth)
+	}
+	metricHeader(&b, "queue_capacity", "gauge", "Async queue capacity.")
+	for _, q := range s.Queues {
+		fmt.Fprintf(&b, "%squeue_capacity{%s} %d\n", metricsPrefix, q.labels(), q.Capacity)
+	}
+	return b.Bytes()
+}
+
+//labels 同名LogFile、AsyncWriter用id区分
+func (f FileStats) labels() string {
+	return fmt.Sprintf("logfile=%q,id=\"%d\"", f.Name, f.ID)
+}
+
+func (q QueueStats) labels() string {
+	return fmt.Sprintf("queue=%q,id=\"%d\"", q.Name, q.ID)
+}
+
+func metricHeader(b *bytes.Buffer, name string, kind string, help string) {
+	fmt.Fprintf(b, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsPrefix, name, help, metricsPrefix, name, kind)
+}
+
+//writeHistogram labels为空或形如logfile="rpc.service01",id="1"
+func writeHistogram(b *bytes.Buffer, name string, labels string, h Histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, bound := range h.Bounds {
+		fmt.Fprintf(b, "%s%s_bucket{%s%sle=\"%s\"} %d\n", metricsPrefix, name, labels, sep,
+			strconv.FormatFloat(bound, 'g', -1, 64), h.Counts[i])
+	}
+	fmt.Fprintf(b, "%s%s_bucket{%s%sle=\"+Inf\"} %d\n", metricsPrefix, name, labels, sep, h.Count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(b, "%s%s_sum%s %s\n", metricsPrefix, name, labels, strconv.FormatFloat(h.Sum, 'g', -1, 64))
+	fmt.Fprintf(b, "%s%s_count%s %d\n", metricsPrefix, name, labels, h.Count)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+//freeAddr 本机未使用的端口
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestServeMetricsReuse(t *testing.T) {
+	defer StopMetrics()
+	addr := freeAddr(t)
+	//重复InitLog使用相同地址时复用已有的监听
+	for i := 0; i < 2; i++ {
+		if err := ServeMetrics(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(body) == 0 {
+		t.Fatalf("status %d body %q", resp.StatusCode, body)
+	}
+
+	//地址变化时关闭之前的监听，之后可以重新监听原地址
+	if err := ServeMetrics(freeAddr(t)); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatalf("%s still listening", addr)
+	}
+	if err := ServeMetrics(addr); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//DefaultNameTemplate 默认日志文件命名：backend.service.YYYYMMDD[.HHMM].NNNNNN
+//支持的占位符：{dir} {backend} {service} {host} {pid} {date} {time} {index:06}
+//{time}为按时间切分的窗口(HHMM)，按天切分时为空，此时前面的"."一并去掉
+const DefaultNameTemplate = "{dir}/{backend}.{service}.{date}.{time}.{index:06}"
+
+var placeholderRegexp = regexp.MustCompile(`\{(\w+)(?::(\d+))?\}`)
+
+var hostname = func() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "localhost"
+	}
+	return host
+}()
+
+//segmentName 日志文件名中各占位符的值
+type segmentName struct {
+	backend string
+	service string
+	date    string //format:YYYYMMDD
+	time    string //format:HHMM
+	index   int64
+	family  string //除日期、时间、序号外的占位符(backend、service、host、pid)，同一family为同一组日志文件
+}
+
+//nameTemplate 日志文件命名模板，路径分隔符统一使用"/"
+type nameTemplate struct {
+	raw   string
+	parts []string //按"/"切分的各级路径，不含{dir}
+}
+
+func parseNameTemplate(tmpl string) (*nameTemplate, error) {
+	if tmpl == "" {
+		tmpl = DefaultNameTemplate
+	}
+	rel := strings.Replace(tmpl, "\\", "/", -1)
+	rel = strings.TrimPrefix(rel, "{dir}")
+	rel = strings.Trim(rel, "/")
+	if strings.Contains(rel, "{dir}") {
+		return nil, fmt.Errorf("name template %s: {dir} must be the first element", tmpl)
+	}
+	parts := strings.Split(rel, "/")
+	if !strings.Contains(parts[len(parts)-1], "{index") {
+		return nil, fmt.Errorf("name template %s: file name must contain {index}", tmpl)
+	}
+	for _, match := range placeholderRegexp.FindAllStringSubmatch(rel, -1) {
+		switch match[1] {
+		case "backend", "service", "host", "pid", "date", "time", "index":
+		default:
+			return nil, fmt.Errorf("name template %s: unknown placeholder %s", tmpl, match[0])
+		}
+	}
+	return &nameTemplate{raw: tmpl, parts: parts}, nil
+}
+
+//render 生成日志文件完整路径
+func (t *nameTemplate) render(dir string, name segmentName) string {
+	elems := make([]string, 0, len(t.parts)+1)
+	elems = append(elems, dir)
+	for _, part := range t.parts {
+		elems = append(elems, renderPart(part, name))
+	}
+	return filepath.Join(elems...)
+}
+
+func renderPart(part string, name segmentName) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range placeholderRegexp.FindAllStringSubmatchIndex(part, -1) {
+		b.WriteString(part[last:loc[0]])
+		last = loc[1]
+		key := part[loc[2]:loc[3]]
+		var value string
+		switch key {
+		case "backend":
+			value = name.backend
+		case "service":
+			value = name.service
+		case "host":
+			value = hostname
+		case "pid":
+			value = strconv.Itoa(os.Getpid())
+		case "date":
+			value = name.date
+		case "time":
+			value = name.time
+		case "index":
+			width := 0
+			if loc[4] >= 0 {
+				width, _ = strconv.Atoi(part[loc[4]:loc[5]])
+			}
+			value = fmt.Sprintf("%0*d", width, name.index)
+		}
+		if value == "" && strings.HasSuffix(b.String(), ".") {
+			s := b.String()
+			b.Reset()
+			b.WriteString(s[:len(s)-1])
+		}
+		b.WriteString(value)
+	}
+	b.WriteString(part[last:])
+	return b.String()
+}
+
+//pattern 生成匹配相对路径的正则，fixed中给定的占位符按字面匹配
+//压缩后的文件(.gz/.zst)同样匹配
+func (t *nameTemplate) pattern(fixed map[string]string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for i, part := range t.parts {
+		if i > 0 {
+			b.WriteString("/")
+		}
+		last := 0
+		for _, loc := range placeholderRegexp.FindAllStringSubmatchIndex(part, -1) {
+			literal := part[last:loc[0]]
+			last = loc[1]
+			key := part[loc[2]:loc[3]]
+			if key == "time" && strings.HasSuffix(literal, ".") {
+				b.WriteString(regexp.QuoteMeta(literal[:len(literal)-1]))
+				b.WriteString(`(?:\.(?P<time>\d{4}))?`)
+				continue
+			}
+			b.WriteString(regexp.QuoteMeta(literal))
+			if value, ok := fixed[key]; ok {
+				b.WriteString("(?P<" + key + ">" + regexp.QuoteMeta(value) + ")")
+				continue
+			}
+			switch key {
+			case "date":
+				b.WriteString(`(?P<date>\d{8})`)
+			case "time":
+				b.WriteString(`(?P<time>\d{4})?`)
+			case "index", "pid":
+				b.WriteString(`(?P<` + key + `>\d+)`)
+			default:
+				b.WriteString(`(?P<` + key + `>[^/]+)`)
+			}
+		}
+		b.WriteString(regexp.QuoteMeta(part[last:]))
+	}
+	b.WriteString(`(?:\.(gz|zst))?$`)
+	return regexp.MustCompile(b.String())
+}
+
+//ownRegexp 匹配某个服务所有日志文件的正则
+func (t *nameTemplate) ownRegexp(backend string, service string) *regexp.Regexp {
+	return t.pattern(map[string]string{
+		"backend": backend,
+		"service": service,
+		"host":    hostname,
+	})
+}
+
+//parseSegmentName 从相对路径解析日志文件名，re须由nameTemplate.pattern生成
+func parseSegmentName(re *regexp.Regexp, rel string) (segmentName, bool) {
+	match := re.FindStringSubmatch(filepath.ToSlash(rel))
+	if match == nil {
+		return segmentName{}, false
+	}
+	var name segmentName
+	for i, key := range re.SubexpNames() {
+		switch key {
+		case "backend":
+			name.backend = match[i]
+		case "service":
+			name.service = match[i]
+		case "date":
+			name.date = match[i]
+		case "time":
+			name.time = match[i]
+		case "index":
+			name.index, _ = strconv.ParseInt(match[i], 10, 64)
+		}
+		switch key {
+		case "backend", "service", "host", "pid":
+			name.family += key + "=" + match[i] + "/"
+		}
+	}
+	return name, true
+}
+
+//SetNameTemplate 设置日志文件命名模板，为空使用DefaultNameTemplate
+func (logfile *LogFile) SetNameTemplate(tmpl string) error {
+	t, err := parseNameTemplate(tmpl)
+	if err != nil {
+		return err
+	}
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	logfile.naming = t
+	return nil
+}
+
+//lastIndex 列出当前时间窗口所在目录，返回已存在日志文件(含压缩文件)的最大序号，调用前需持有lock
+func (logfile *LogFile) lastIndex() int64 {
+	fpath, err := segmentFile(*logfile)
+	if err != nil {
+		return 0
+	}
+	dir := filepath.Dir(fpath)
+	infos, err := logfile.fs.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	own := logfile.naming.ownRegexp(logfile.backendname, logfile.servicename)
+	var index int64
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		rel, err := filepath.Rel(logfile.filepath, filepath.Join(dir, info.Name()))
+		if err != nil {
+			continue
+		}
+		name, ok := parseSegmentName(own, rel)
+		if !ok || name.date != logfile.curdate || name.time != logfile.curwindow {
+			continue
+		}
+		if name.index > index {
+			index = name.index
+		}
+	}
+	return index
+}
@@ -10,9 +10,36 @@ import (
 type LogCfg struct {
 	LogLevel    string `yaml:"level"`       //日志等级
 	MaxFileSize int64  `yaml:"filesize"`    //最大日志文件大小（M）
+	MaxLines    int64  `yaml:"maxlines"`    //单个日志文件最大日志条数（多行日志算一条），0：不限制
 	BackendName string `yaml:"backendname"` //后端名(rpc)
 	ServerName  string `yaml:"servername"`  //服务名(service)
 	LogField    string `yaml:"logfield"`    //日志打印域控制
+	RotateTime  int64  `yaml:"rotatetime"`  //按时间切分日志间隔（分钟），0：按天，60：按小时
+	MaxAge      int    `yaml:"maxage"`      //日志文件保留天数，0：不清理
+	MaxFiles    int    `yaml:"maxfiles"`    //每个服务保留日志文件个数，0：不限制
+	MaxDirSize  int64  `yaml:"maxdirsize"`  //日志目录最大占用（M），0：不限制
+	ArchivePath string `yaml:"archivepath"` //过期日志归档目录，为空则直接删除
+	Compress    string `yaml:"compress"`    //切分后日志压缩格式（gzip、zstd），为空不压缩
+	AsyncQueue  int    `yaml:"asyncqueue"`  //异步写日志队列长度，0：同步写
+	AsyncPolicy string `yaml:"asyncpolicy"` //异步队列满时策略（block、dropnewest、droplevel）
+	SyncPolicy  string `yaml:"syncpolicy"`  //落盘策略（always、interval、error、never）
+	SyncTime    int64  `yaml:"synctime"`    //interval落盘间隔（毫秒）
+	NameFormat  string `yaml:"nameformat"`  //日志文件命名模板，为空使用默认模板
+	CurrentLink bool   `yaml:"currentlink"` //是否维护指向当前日志文件的backend.service.current软链接
+	ReopenSig   string `yaml:"reopensig"`   //收到该信号时重新打开日志文件（如SIGHUP），为空不处理
+	Fallback    string `yaml:"fallback"`    //日志目录不可写时的备用目录，为空输出到stderr
+	Shared      bool   `yaml:"shared"`      //多进程共享同一组日志文件时开启，通过文件锁协调切分
+	Cutover     string `yaml:"cutover"`     //会计日切换时间（HH:MM），如23:00、02:00，为空按自然日
+	TimeZone    string `yaml:"timezone"`    //会计日期时区，如Asia/Shanghai，为空使用本地时区
+	Header      bool   `yaml:"header"`      //是否在日志文件首行写入header，切分时在文件末尾写入footer
+	AuditKey    string `yaml:"auditkey"`    //审计日志HMAC密钥文件，非空时开启AuditLogger，写入服务名.audit文件
+	EncryptKey  string `yaml:"encryptkey"`  //日志文件加密(AES-GCM)密钥文件，多个用逗号分隔，第一个用于加密，为空不加密
+	LineCRC     bool   `yaml:"linecrc"`     //是否在每行首列输出该行内容的CRC32，用于检测位翻转和不完整写入
+	MetricsAddr string `yaml:"metricsaddr"` //日志指标监听地址（如:9108），提供/metrics和/debug/vars，为空不开启
+	StallTime   int64  `yaml:"stalltime"`   //单次写入超过该时间（毫秒）视为卡住，0：不检测
+	StallPolicy string `yaml:"stallpolicy"` //写入卡住时策略（wait、fallback、drop）
+	Deadline    int64  `yaml:"deadline"`    //单次写入最长等待时间（毫秒），0：不限制
+	Watermark   string `yaml:"watermark"`   //磁盘剩余空间水位线（剩余百分比:级别），如10:info,2:error，为空不调整
 }
 
 func LoadYamlConfig() (*LogCfg,error){
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pressureInterval   = 10 * time.Second //默认检查间隔
+	pressureHysteresis = 1.0              //恢复时剩余空间需高于水位线的百分点，避免在水位线附近反复切换
+)
+
+//Watermark 日志目录剩余空间低于FreePercent(%)时，只输出Level及以上级别的日志
+type Watermark struct {
+	FreePercent float64
+	Level       logrus.Level
+}
+
+//解析配置文件中watermark，格式为 剩余百分比:级别，多个用逗号分隔，如10:info,2:error
+func watermarksforCfg(cfg string) ([]Watermark, error) {
+	var marks []Watermark
+	for _, item := range strings.Split(cfg, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid watermark %q, expect percent:level", item)
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(parts[0]), "%"), 64)
+		if err != nil || percent <= 0 || percent >= 100 {
+			return nil, fmt.Errorf("invalid watermark percent %q", parts[0])
+		}
+		marks = append(marks, Watermark{FreePercent: percent, Level: logLevelforCfg(strings.TrimSpace(parts[1]))})
+	}
+	return marks, nil
+}
+
+//DiskPressure 按LogFile目录的剩余空间调整Logger的最低级别，空间恢复后还原为配置的级别
+//每次级别变化向Logger的输出写入一行Warn级别的通知(不受当前级别限制)
+//Logger的级别被外部修改(如重新InitLog、SetLevel)时，以新级别作为配置的级别
+type DiskPressure struct {
+	lock    sync.Mutex
+	logger  *logrus.Logger
+	logfile *LogFile
+	marks   []Watermark
+	base    logrus.Level //配置的级别
+	current logrus.Level //当前生效的级别
+	free    float64      //最近一次检查的剩余百分比
+	statfs  func(dir string) (free uint64, total uint64, err error)
+	lasterr string
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+//NewDiskPressure 立即检查一次，之后每interval检查一次(0使用默认10秒)，Close停止
+func NewDiskPressure(logger *logrus.Logger, logfile *LogFile, marks []Watermark, interval time.Duration) *DiskPressure {
+	if interval <= 0 {
+		interval = pressureInterval
+	}
+	sorted := append([]Watermark(nil), marks...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].FreePercent > sorted[j].FreePercent
+	})
+	p := &DiskPressure{
+		logger:  logger,
+		logfile: logfile,
+		marks:   sorted,
+		base:    logger.GetLevel(),
+		current: logger.GetLevel(),
+		free:    100,
+		statfs:  diskFree,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	p.Check()
+	go p.run(interval)
+	return p
+}
+
+func (p *DiskPressure) run(interval time.Duration) {
+	defer close(p.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.Check()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+//Close 停止检查并还原配置的级别
+func (p *DiskPressure) Close() {
+	close(p.stop)
+	<-p.done
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.logger.GetLevel() == p.current && p.current != p.base {
+		p.logger.SetLevel(p.base)
+	}
+}
+
+//Level 配置的级别和当前生效的级别
+func (p *DiskPressure) Level() (base logrus.Level, current logrus.Level) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.base, p.current
+}
+
+//Check 检查剩余空间并调整级别
+func (p *DiskPressure) Check() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if level := p.logger.GetLevel(); level != p.current {
+		p.base, p.current = level, level
+	}
+	dir := p.logfile.dir()
+	free, total, err := p.statfs(dir)
+	if err != nil || total == 0 {
+		if err != nil && err.Error() != p.lasterr {
+			stdlog.Println("check log disk space error: ", err)
+			p.lasterr = err.Error()
+		}
+		return
+	}
+	p.lasterr = ""
+	percent := float64(free) * 100 / float64(total)
+	level := p.base
+	for _, mark := range p.marks {
+		limit := mark.FreePercent
+		//已经低于该水位线时，需高出一定空间才恢复
+		if p.free < limit {
+			limit += pressureHysteresis
+		}
+		if percent < limit && mark.Level < level {
+			level = mark.Level
+		}
+	}
+	p.free = percent
+	if level == p.current {
+		return
+	}
+	var msg string
+	if level < p.current {
+		msg = fmt.Sprintf("disk pressure: %.1f%% free on %s, log level raised from %s to %s", percent, dir, p.current, level)
+	} else if level == p.base {
+		msg = fmt.Sprintf("disk space recovered: %.1f%% free on %s, log level restored to %s", percent, dir, level)
+	} else {
+		msg = fmt.Sprintf("disk space partly recovered: %.1f%% free on %s, log level lowered from %s to %s", percent, dir, p.current, level)
+	}
+	p.current = level
+	p.logger.SetLevel(level)
+	p.notice(msg)
+}
+
+//notice 直接格式化后写入Logger的输出，不受当前级别限制
+func (p *DiskPressure) notice(msg string) {
+	stdlog.Println(msg)
+	entry := logrus.NewEntry(p.logger)
+	entry.Time = time.Now()
+	entry.Level = logrus.WarnLevel
+	entry.Message = msg
+	data, err := p.logger.Formatter.Format(entry)
+	if err == nil {
+		_, err = p.logger.Out.Write(data)
+	}
+	if err != nil {
+		stdlog.Println("write disk pressure notice error: ", err)
+	}
+}
+
+//dir 日志目录
+func (logfile *LogFile) dir() string {
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	return logfile.filepath
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"testing"
+)
+
+//stubStatfs 替换剩余空间检查，返回*free/100
+func stubStatfs(p *DiskPressure, free *uint64, err *error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.statfs = func(string) (uint64, uint64, error) {
+		return *free, 100, *err
+	}
+}
+
+func TestWatermarksforCfg(t *testing.T) {
+	marks, err := watermarksforCfg("2:error, 10%:info")
+	if err != nil || len(marks) != 2 || marks[1].FreePercent != 10 || marks[1].Level != logrus.InfoLevel {
+		t.Fatalf("%v %v", marks, err)
+	}
+	for _, cfg := range []string{"x:info", "10", "0:info", "100:info"} {
+		if _, err := watermarksforCfg(cfg); err == nil {
+			t.Errorf("%q: want error", cfg)
+		}
+	}
+}
+
+func TestDiskPressureCheck(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	logger.SetFormatter(&Formatter{})
+	logger.SetLevel(logrus.TraceLevel)
+	logfile := NewLogFile()
+	defer logfile.Close()
+	logfile.SetFilePath(t.TempDir())
+	marks, _ := watermarksforCfg("2:error,10:info")
+	p := NewDiskPressure(logger, logfile, marks, 0)
+	defer func() {
+		if p != nil {
+			p.Close()
+		}
+	}()
+
+	free, serr := uint64(50), error(nil)
+	stubStatfs(p, &free, &serr)
+	steps := []struct {
+		free uint64
+		want logrus.Level
+	}{
+		{50, logrus.TraceLevel},
+		{9, logrus.InfoLevel},
+		{10, logrus.InfoLevel}, //高于水位线不足1个百分点，不恢复
+		{1, logrus.ErrorLevel},
+		{2, logrus.ErrorLevel},
+		{5, logrus.InfoLevel},
+		{11, logrus.TraceLevel},
+	}
+	for _, step := range steps {
+		free = step.free
+		p.Check()
+		if level := logger.GetLevel(); level != step.want {
+			t.Fatalf("free %d%%: level %s, want %s", step.free, level, step.want)
+		}
+	}
+	if n := strings.Count(out.String(), "[LOGWAN]"); n != 4 {
+		t.Fatalf("%d notices:\n%s", n, out.String())
+	}
+
+	//检查失败时保持当前级别
+	free = 1
+	p.Check()
+	serr = errors.New("statfs failed")
+	free = 50
+	p.Check()
+	if level := logger.GetLevel(); level != logrus.ErrorLevel {
+		t.Fatalf("level %s after statfs error", level)
+	}
+
+	//外部修改的级别作为配置的级别
+	serr = nil
+	logger.SetLevel(logrus.DebugLevel)
+	free = 5
+	p.Check()
+	if base, current := p.Level(); base != logrus.DebugLevel || current != logrus.InfoLevel {
+		t.Fatalf("base %s current %s", base, current)
+	}
+	//Close还原配置的级别
+	p.Close()
+	p = nil
+	if level := logger.GetLevel(); level != logrus.DebugLevel {
+		t.Fatalf("level %s after close", level)
+	}
+}
+
+func TestDiskFree(t *testing.T) {
+	free, total, err := diskFree(t.TempDir())
+	if err != nil || total == 0 || free > total {
+		t.Fatalf("free %d total %d err %v", free, total, err)
+	}
+}
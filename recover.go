@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+//tornPrefix 进程被杀时文件末尾可能留下不完整的行，重新打开时补换行并追加该标记行，之后的日志从新行开始
+//#LOGTORN bytes=不完整行的长度 recovered=恢复时间，审计模式下末尾追加串联了不完整行的hmac
+const tornPrefix = "#LOGTORN "
+
+//recoverTail 检查文件末尾是否为不完整的行，是则补换行并写入标记行，避免下一条日志与其合并为一行
+//src为同一文件只读打开的句柄，size为文件大小，加密文件按帧写入不需要恢复，审计模式下链需已恢复到最后一个完整的行，调用前需持有lock
+func (logfile *LogFile) recoverTail(file File, src File, size int64) {
+	ra, ok := src.(io.ReaderAt)
+	if !ok || size == 0 {
+		return
+	}
+	fragment, err := tailFragment(ra, size)
+	if err != nil {
+		stdlog.Println("check log file tail error: ", err)
+		return
+	}
+	if fragment == 0 {
+		return
+	}
+	marker := fmt.Sprintf("%sbytes=%d recovered=%s", tornPrefix, fragment, logfile.clock.Now().Format(time.RFC3339Nano))
+	var chain []byte
+	if logfile.auditkey != nil {
+		data := make([]byte, fragment)
+		if _, err := ra.ReadAt(data, size-fragment); err != nil {
+			stdlog.Println("check log file tail error: ", err)
+			return
+		}
+		chain = tornSum(logfile.auditkey, logfile.chain, data, []byte(marker))
+		marker += auditField + chainHex(chain)
+	}
+	marker = "\n" + marker + "\n"
+	if _, err := io.WriteString(file, marker); err != nil {
+		stdlog.Println("recover torn log line error: ", err)
+		return
+	}
+	if chain != nil {
+		logfile.chain = chain
+	}
+	logfile.crc = crc32.Update(logfile.crc, crc32.IEEETable, []byte(marker))
+	atomic.AddInt64(&logfile.filesize, int64(len(marker)))
+	stdlog.Printf("recovered torn last line (%d bytes) in %s", fragment, file.Name())
+}
+
+//tailFragment 从文件末尾向前查找换行，返回最后一行不完整部分的长度，0表示以换行结尾
+func tailFragment(ra io.ReaderAt, size int64) (int64, error) {
+	buf := make([]byte, 4096)
+	for end := size; end > 0; {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		n, err := ra.ReadAt(buf[:end-start], start)
+		if int64(n) < end-start {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if idx := bytes.LastIndexByte(buf[:n], '\n'); idx >= 0 {
+			return size - start - int64(idx) - 1, nil
+		}
+		end = start
+	}
+	return size, nil
+}
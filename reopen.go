@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+)
+
+//Reopen 关闭并重新打开当前日志文件，用于外部logrotate移动或截断文件后
+func (logfile *LogFile) Reopen() error {
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	if logfile.file == nil {
+		return nil
+	}
+	//先打开新文件再替换，其他协程的Write不会拿到nil
+	file, err := logfile.open(*logfile)
+	if err != nil {
+		return fmt.Errorf("reopen log file error: %s", err)
+	}
+	logfile.rotateTo(file, false)
+	return nil
+}
+
+//ReopenAll 重新打开所有已注册LogFile的当前日志文件
+func ReopenAll() {
+	logfiles.Lock()
+	list := make([]*LogFile, 0, len(logfiles.m))
+	for logfile := range logfiles.m {
+		list = append(list, logfile)
+	}
+	logfiles.Unlock()
+	for _, logfile := range list {
+		if err := logfile.Reopen(); err != nil {
+			stdlog.Println(err)
+		}
+	}
+}
+
+var reopenSignal struct {
+	sync.Mutex
+	ch   chan os.Signal
+	done chan struct{}
+}
+
+//HandleReopenSignal 收到指定信号(默认SIGHUP)时重新打开所有LogFile
+func HandleReopenSignal(sigs ...os.Signal) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{reopenSignalNames["SIGHUP"]}
+	}
+	StopReopenSignal()
+	reopenSignal.Lock()
+	defer reopenSignal.Unlock()
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, sigs...)
+	go func() {
+		for {
+			select {
+			case <-ch:
+				ReopenAll()
+			case <-done:
+				return
+			}
+		}
+	}()
+	reopenSignal.ch = ch
+	reopenSignal.done = done
+}
+
+//StopReopenSignal 停止信号处理
+func StopReopenSignal() {
+	reopenSignal.Lock()
+	defer reopenSignal.Unlock()
+	if reopenSignal.ch == nil {
+		return
+	}
+	signal.Stop(reopenSignal.ch)
+	close(reopenSignal.done)
+	reopenSignal.ch = nil
+	reopenSignal.done = nil
+}
+
+//解析配置文件中reopensignal
+func reopenSignalforCfg(name string) (os.Signal, error) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := reopenSignalNames[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported reopen signal %s", name)
+	}
+	return sig, nil
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+//windows不会投递SIGHUP，需由程序自行调用Reopen/ReopenAll
+var reopenSignalNames = map[string]os.Signal{
+	"SIGHUP": syscall.SIGHUP,
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+//ErrSharedConflict 多进程共享模式与maxlines、加密、审计、watchdog或自定义文件系统同时开启
+var ErrSharedConflict = errors.New("shared log file can't be used with maxlines, encryption, audit, watchdog or a custom file system")
+
+//SetShared 开启多进程共享模式：多个进程使用相同backendname/servicename写同一组日志文件时，
+//通过日志目录下的backend.service.lock文件加锁，保证整行写入且切分序号连续
+//共享模式不支持maxlines、加密、审计、watchdog和自定义文件系统，已设置时返回ErrSharedConflict，
+//开启共享模式后再设置这些选项，写入时返回ErrSharedConflict
+func (logfile *LogFile) SetShared(shared bool) error {
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	if shared && logfile.sharedConflict() {
+		return ErrSharedConflict
+	}
+	logfile.shared = shared
+	if !shared && logfile.lockfile != nil {
+		logfile.lockfile.Close()
+		logfile.lockfile = nil
+	}
+	return nil
+}
+
+//sharedConflict 是否设置了共享模式不支持的选项，调用前需持有lock
+func (logfile *LogFile) sharedConflict() bool {
+	return logfile.maxlines > 0 || logfile.keys != nil || logfile.auditkey != nil ||
+		logfile.watchdog.threshold > 0 || logfile.watchdog.deadline > 0 || logfile.fs != OSFS
+}
+
+//familyLock 打开锁文件，文件内容记录当前正在写入的时间窗口和序号，调用前需持有lock
+func (logfile *LogFile) familyLock() (*os.File, error) {
+	if logfile.lockfile != nil {
+		return logfile.lockfile, nil
+	}
+	if err := os.MkdirAll(logfile.filepath, 0755); err != nil {
+		return nil, err
+	}
+	fpath := filepath.Join(logfile.filepath, logfile.backendname+"."+logfile.servicename+".lock")
+	file, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE, 0664)
+	if err != nil {
+		return nil, fmt.Errorf("open log lock file %s error: %s", fpath, err)
+	}
+	logfile.lockfile = file
+	return file, nil
+}
+
+//windowKey 当前时间窗口标识：YYYYMMDD或YYYYMMDD.HHMM
+func (logfile *LogFile) windowKey() string {
+	if logfile.curwindow == "" {
+		return logfile.curdate
+	}
+	return logfile.curdate + "." + logfile.curwindow
+}
+
+func readSharedState(file *os.File) (key string, index int64, ok bool) {
+	buf := make([]byte, 64)
+	n, _ := file.ReadAt(buf, 0)
+	if _, err := fmt.Sscan(string(buf[:n]), &key, &index); err != nil {
+		return "", 0, false
+	}
+	return key, index, true
+}
+
+func writeSharedState(file *os.File, key string, index int64) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := file.WriteAt([]byte(fmt.Sprintf("%s %d\n", key, index)), 0)
+	return err
+}
+
+//writeShared 共享模式下的写入：持有文件锁期间完成切分判断和整行写入，调用前需持有lock
+func (logfile *LogFile) writeShared(data []byte, now time.Time) (n int, e error) {
+	lockfile, err := logfile.familyLock()
+	if err == nil {
+		if err = lockFile(lockfile); err == nil {
+			defer unlockFile(lockfile)
+		}
+	}
+	if err != nil {
+		if logfile.file == nil || !logfile.degraded {
+			logfile.degrade(err)
+		}
+		return logfile.file.Write(data)
+	}
+
+	if logfile.file == nil {
+		logfile.setWindow(now)
+		logfile.setFile()
+		logfile.emit(SegmentInfo{}, logfile.segment())
+	} else if !now.Before(logfile.windowend) {
+		//锁文件仍记录旧窗口时由本进程切换窗口并压缩旧文件，其他进程只关闭
+		key, _, ok := readSharedState(lockfile)
+		logfile.rollWindow(now, !ok || key == logfile.windowKey())
+	}
+	logfile.retryPrimary(now)
+
+	if !logfile.degraded {
+		key, index, ok := readSharedState(lockfile)
+		if ok && key == logfile.windowKey() && index > logfile.curindex {
+			//其他进程已经切分，跟随到最新的文件
+			logfile.curindex = index
+			if file, err := openFile(*logfile); err != nil {
+				logfile.degrade(err)
+			} else {
+				logfile.rotateTo(file, false)
+			}
+		}
+		if !logfile.degraded {
+			fInfo, err := logfile.file.Stat()
+			if err == nil && fInfo.Size() > 0 && fInfo.Size()+int64(len(data)) > logfile.maxsize*1024*1024 {
+				logfile.curindex++
+				if file, err := openFile(*logfile); err != nil {
+					logfile.degrade(err)
+				} else {
+					logfile.rotateTo(file, true)
+				}
+			}
+		}
+		if !logfile.degraded && (!ok || key != logfile.windowKey() || index != logfile.curindex) {
+			if err := writeSharedState(lockfile, logfile.windowKey(), logfile.curindex); err != nil {
+				stdlog.Println("write log lock file error: ", err)
+			}
+		}
+	}
+
+	file := logfile.file
+	n, e = file.Write(data)
+	if e != nil {
+		atomic.AddUint64(&logfile.stats.errors, 1)
+	}
+	if e != nil && !logfile.degraded {
+		logfile.degrade(fmt.Errorf("write log file %s error: %s", file.Name(), e))
+		n, e = logfile.file.Write(data)
+	}
+	atomic.AddUint64(&logfile.stats.bytes, uint64(n))
+	if fInfo, err := logfile.file.Stat(); err == nil {
+		atomic.StoreInt64(&logfile.filesize, fInfo.Size())
+	}
+	atomic.StoreInt64(&logfile.lastwrite, now.UnixNano())
+	if e == nil && logfile.needSync(data) {
+		logfile.file.Sync()
+	}
+	return n, e
+}
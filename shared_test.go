@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSharedConflict(t *testing.T) {
+	logfile := NewLogFile()
+	logfile.SetFilePath(t.TempDir())
+	logfile.SetBackendName("rpc")
+	logfile.SetServiceName("svc")
+	if err := logfile.SetShared(true); err != nil {
+		t.Fatal(err)
+	}
+	//开启共享模式后再开启审计，写入失败而不是写出没有hmac的日志
+	logfile.SetAudit([]byte("key"))
+	if n, err := logfile.Write([]byte("[LOGINF] a\n")); n != 0 || err != ErrSharedConflict {
+		t.Fatalf("write with audit: n=%d err=%v", n, err)
+	}
+	logfile.Close()
+
+	//MemFS不支持文件锁，不能静默关闭共享模式
+	logfile = newTestLogFile(NewMemFS(nil), nil)
+	if err := logfile.SetShared(true); err != ErrSharedConflict {
+		t.Fatalf("SetShared on MemFS: %v", err)
+	}
+	logfile.SetFileSystem(OSFS)
+	if err := logfile.SetShared(true); err != nil {
+		t.Fatal(err)
+	}
+	logfile.SetFileSystem(NewMemFS(nil))
+	if _, err := logfile.Write([]byte("[LOGINF] a\n")); err != ErrSharedConflict {
+		t.Fatalf("write on MemFS: %v", err)
+	}
+	logfile.Close()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+//日志落盘策略
+type SyncPolicy int
+
+const (
+	SyncAlways   SyncPolicy = iota //每次写入都落盘(O_SYNC)
+	SyncInterval                   //按时间间隔落盘
+	SyncError                      //Error及以上级别日志落盘
+	SyncNever                      //由操作系统决定
+)
+
+//解析配置文件中syncpolicy
+func syncPolicyforCfg(policy string) SyncPolicy {
+	switch strings.ToLower(policy) {
+	case "interval":
+		return SyncInterval
+	case "error":
+		return SyncError
+	case "never":
+		return SyncNever
+	default:
+		return SyncAlways
+	}
+}
+
+type syncer struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+//SetSyncPolicy 设置落盘策略，interval仅对SyncInterval有效
+//Close以及Fatal/Panic日志总是落盘
+func (logfile *LogFile) SetSyncPolicy(policy SyncPolicy, interval time.Duration) {
+	logfile.lock.Lock()
+	old := logfile.syncer
+	logfile.syncer = nil
+	logfile.syncpolicy = policy
+	if policy == SyncInterval {
+		if interval <= 0 {
+			interval = time.Second
+		}
+		logfile.syncer = &syncer{stop: make(chan struct{}), done: make(chan struct{})}
+		go logfile.syncer.run(logfile, interval)
+	}
+	logfile.lock.Unlock()
+	if old != nil {
+		old.close()
+	}
+}
+
+func (s *syncer) run(logfile *LogFile, interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			logfile.Sync()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *syncer) close() {
+	close(s.stop)
+	<-s.done
+}
+
+func (logfile *LogFile) stopSyncer() {
+	logfile.lock.Lock()
+	s := logfile.syncer
+	logfile.syncer = nil
+	logfile.lock.Unlock()
+	if s != nil {
+		s.close()
+	}
+}
+
+//Sync 将当前日志文件落盘
+func (logfile *LogFile) Sync() error {
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	if logfile.file == nil {
+		return nil
+	}
+	if logfile.stalled() && logfile.busy(logfile.file) {
+		return ErrWriteStalled
+	}
+	err := logfile.syncFile(logfile.file)
+	if isStall(err) {
+		logfile.abandon(logfile.file, err)
+	}
+	return err
+}
+
+//needSync 根据落盘策略和日志级别判断写入后是否需要落盘
+func (logfile *LogFile) needSync(entries ...[]byte) bool {
+	threshold := logrus.FatalLevel
+	switch logfile.syncpolicy {
+	case SyncAlways:
+		return false //O_SYNC已落盘
+	case SyncError:
+		threshold = logrus.ErrorLevel
+	}
+	for _, data := range entries {
+		if minLineLevel(data) <= threshold {
+			return true
+		}
+	}
+	return false
+}
+
+//closeFile 关闭文件，非O_SYNC打开的文件关闭前先落盘，有卡住的操作时由stalled在完成后关闭，返回是否已关闭，调用前需持有lock
+func (logfile *LogFile) closeFile(file File) bool {
+	if isStderr(file) || logfile.busy(file) {
+		return false
+	}
+	if logfile.syncpolicy != SyncAlways {
+		if err := logfile.syncFile(file); isStall(err) {
+			return false
+		} else if err != nil {
+			stdlog.Println("sync file error: ", err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		stdlog.Println("close file error: ", err)
+	}
+	return true
+}
+
+//minLineLevel 多行日志(异步批量写入)中最高的日志级别
+func minLineLevel(data []byte) logrus.Level {
+	level := logrus.TraceLevel
+	for len(data) > 0 {
+		line := data
+		if idx := bytes.IndexByte(data, '\n'); idx >= 0 {
+			line, data = data[:idx+1], data[idx+1:]
+		} else {
+			data = nil
+		}
+		if l, ok := lineLevel(line); ok && l < level {
+			level = l
+		}
+	}
+	return level
+}
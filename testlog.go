@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"sync"
 	"time"
 )
@@ -26,6 +27,9 @@ func printf(i int) {
 }
 
 func main() {
+	if runCommand(os.Args[1:]) {
+		return
+	}
 	config,err := LoadYamlConfig()
 	fmt.Println(err)
 	InitLog(config)
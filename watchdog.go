@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//写入卡住(如NFS挂起)时的处理策略
+type StallPolicy int
+
+const (
+	StallWait     StallPolicy = iota //只报告，继续等待写入完成(设置了deadline时超时返回错误)
+	StallFallback                    //切换到备用目录或stderr，卡住的写入完成后重新打开日志目录
+	StallDrop                        //丢弃日志直到卡住的写入完成
+)
+
+var (
+	//ErrWriteStalled 之前的写入仍未完成，本次写入未执行
+	ErrWriteStalled = errors.New("log write stalled")
+	//ErrWriteTimeout 写入超过deadline未完成
+	ErrWriteTimeout = errors.New("log write deadline exceeded")
+)
+
+//解析配置文件中stallpolicy
+func stallPolicyforCfg(policy string) StallPolicy {
+	switch strings.ToLower(policy) {
+	case "fallback":
+		return StallFallback
+	case "drop":
+		return StallDrop
+	default:
+		return StallWait
+	}
+}
+
+//StallEvent 写入卡住事件，Recovered为true时卡住的写入已完成，Duration为已卡住的时长
+type StallEvent struct {
+	Path      string
+	Start     time.Time
+	Duration  time.Duration
+	Recovered bool
+}
+
+//watchdog 写入卡住检测，threshold、deadline都为0时直接写入
+type watchdog struct {
+	threshold time.Duration
+	deadline  time.Duration
+	policy    StallPolicy
+	onstall   func(event StallEvent)
+	pending   *pendingWrite //已放弃等待但仍未完成的写入
+}
+
+//pendingWrite 执行中的文件操作：写入、落盘或打开文件(file为nil)
+type pendingWrite struct {
+	path    string
+	file    File
+	data    []byte
+	entries int
+	start   time.Time
+	done    chan writeResult
+}
+
+type writeResult struct {
+	n    int
+	file File //打开的文件
+	err  error
+}
+
+//SetWatchdog 写入超过threshold未完成时视为卡住，调用onstall(为nil时输出诊断日志)并按policy处理，threshold为0关闭
+//卡住的写入完成后再次调用onstall(Recovered为true)；开启后每次写入、落盘和打开文件在单独的协程中执行，多进程共享模式下不支持
+func (logfile *LogFile) SetWatchdog(threshold time.Duration, policy StallPolicy, onstall func(event StallEvent)) {
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	logfile.watchdog.threshold = threshold
+	logfile.watchdog.policy = policy
+	logfile.watchdog.onstall = onstall
+}
+
+//SetWriteDeadline 单次写入、落盘或打开文件最长等待时间，超时返回ErrWriteTimeout，之后的写入按卡住策略处理直到卡住的操作完成，0不限制
+//超时的内容可能在写入恢复后仍然写入文件，StallFallback时备用文件中会重复
+func (logfile *LogFile) SetWriteDeadline(deadline time.Duration) {
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
+	logfile.watchdog.deadline = deadline
+}
+
+//guard 开启watchdog时在单独的协程中执行op，超过threshold报告卡住，按策略放弃等待时返回ErrWriteStalled，
+//超过deadline返回ErrWriteTimeout，放弃的操作记录在pending中由stalled处理，已有卡住的操作时直接执行，调用前需持有lock
+func (logfile *LogFile) guard(p *pendingWrite, op func() writeResult) writeResult {
+	w := &logfile.watchdog
+	if (w.threshold <= 0 && w.deadline <= 0) || w.pending != nil {
+		return op()
+	}
+	p.start = time.Now()
+	p.done = make(chan writeResult, 1)
+	go func() {
+		p.done <- op()
+	}()
+	var stallC, deadlineC <-chan time.Time
+	if w.threshold > 0 {
+		timer := time.NewTimer(w.threshold)
+		defer timer.Stop()
+		stallC = timer.C
+	}
+	if w.deadline > 0 {
+		timer := time.NewTimer(w.deadline)
+		defer timer.Stop()
+		deadlineC = timer.C
+	}
+	reported := false
+	for {
+		select {
+		case res := <-p.done:
+			if reported {
+				logfile.notifyStall(p, true)
+			}
+			return res
+		case <-stallC:
+			stallC = nil
+			reported = true
+			logfile.notifyStall(p, false)
+			if w.policy != StallWait {
+				w.pending = p
+				return writeResult{err: ErrWriteStalled}
+			}
+		case <-deadlineC:
+			if !reported {
+				logfile.notifyStall(p, false)
+			}
+			w.pending = p
+			return writeResult{err: ErrWriteTimeout}
+		}
+	}
+}
+
+//writeFile 写入包含entries条日志的data，调用前需持有lock
+func (logfile *LogFile) writeFile(file File, data []byte, entries int) (int, error) {
+	if isStderr(file) {
+		return file.Write(data)
+	}
+	//放弃等待后调用方会复用data，需要拷贝
+	p := &pendingWrite{path: file.Name(), file: file, data: append([]byte(nil), data...), entries: entries}
+	res := logfile.guard(p, func() writeResult {
+		n, err := file.Write(p.data)
+		return writeResult{n: n, err: err}
+	})
+	return res.n, res.err
+}
+
+//syncFile 落盘，调用前需持有lock
+func (logfile *LogFile) syncFile(file File) error {
+	if isStderr(file) {
+		return file.Sync()
+	}
+	return logfile.guard(&pendingWrite{path: file.Name(), file: file}, func() writeResult {
+		return writeResult{err: file.Sync()}
+	}).err
+}
+
+//open 打开target对应的日志文件(含创建目录、写入header)，调用前需持有lock
+func (logfile *LogFile) open(target LogFile) (File, error) {
+	fpath, _ := segmentFile(target)
+	res := logfile.guard(&pendingWrite{path: fpath}, func() writeResult {
+		file, err := openFile(target)
+		return writeResult{file: file, err: err}
+	})
+	return res.file, res.err
+}
+
+//isStall 操作是否因卡住而放弃等待
+func isStall(err error) bool {
+	return err == ErrWriteStalled || err == ErrWriteTimeout
+}
+
+//abandon 当前文件的操作卡住，StallFallback时切换到备用目录或stderr，卡住的文件由stalled在操作完成后关闭，调用前需持有lock
+func (logfile *LogFile) abandon(file File, err error) {
+	if logfile.watchdog.policy != StallFallback || file != logfile.file {
+		return
+	}
+	logfile.file = nil
+	logfile.degrade(fmt.Errorf("log file %s stalled: %s", file.Name(), err))
+}
+
+//busy 文件是否有卡住的操作，调用前需持有lock
+func (logfile *LogFile) busy(file File) bool {
+	p := logfile.watchdog.pending
+	return p != nil && p.file != nil && p.file == file
+}
+
+//stalled 是否有仍未完成的操作，已完成时报告恢复，写入计入文件大小，已切换的文件关闭，调用前需持有lock
+func (logfile *LogFile) stalled() bool {
+	p := logfile.watchdog.pending
+	if p == nil {
+		return false
+	}
+	select {
+	case res := <-p.done:
+		logfile.watchdog.pending = nil
+		logfile.notifyStall(p, true)
+		switch {
+		case p.file == nil:
+			//已放弃的打开
+			if res.file != nil {
+				logfile.closeFile(res.file)
+			}
+		case p.file == logfile.file:
+			if p.data != nil {
+				entries := p.entries
+				if res.n < len(p.data) {
+					entries = 0
+				}
+				atomic.AddUint64(&logfile.stats.bytes, uint64(res.n))
+				atomic.AddInt64(&logfile.filesize, int64(res.n)+logfile.overhead(res.n))
+				logfile.record(p.data[:res.n], entries, logfile.clock.Now())
+			}
+		default:
+			//已切换到备用目录或新文件
+			logfile.closeFile(p.file)
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+//dropStalled 卡住期间的写入：StallDrop丢弃，StallWait返回错误，调用前需持有lock
+func (logfile *LogFile) dropStalled(entries [][]byte) (int, error) {
+	if logfile.watchdog.policy == StallDrop {
+		atomic.AddUint64(&logfile.stats.dropped, uint64(len(entries)))
+		n := 0
+		for _, entry := range entries {
+			n += len(entry)
+		}
+		return n, nil
+	}
+	return 0, ErrWriteStalled
+}
+
+//notifyStall 记录指标并在单独的协程中调用onstall，调用前需持有lock
+func (logfile *LogFile) notifyStall(p *pendingWrite, recovered bool) {
+	event := StallEvent{Path: p.path, Start: p.start, Duration: time.Since(p.start), Recovered: recovered}
+	if recovered {
+		atomic.StoreInt32(&logfile.stats.stalled, 0)
+	} else {
+		atomic.AddUint64(&logfile.stats.stalls, 1)
+		atomic.StoreInt32(&logfile.stats.stalled, 1)
+	}
+	handler := logfile.watchdog.onstall
+	if handler == nil {
+		if recovered {
+			stdlog.Printf("log write recovered after %s: %s", event.Duration, event.Path)
+		} else {
+			stdlog.Printf("log write stalled for %s: %s", event.Duration, event.Path)
+		}
+		return
+	}
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				stdlog.Printf("log stall handler panic: %v\n%s", e, debug.Stack())
+			}
+		}()
+		handler(event)
+	}()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//stallFS 通过SetFault让/logs下文件的写入阻塞，release后恢复
+type stallFS struct {
+	*MemFS
+	block int32
+	gate  chan struct{}
+}
+
+func newStallFS(clock Clock) *stallFS {
+	fs := &stallFS{MemFS: NewMemFS(clock), gate: make(chan struct{})}
+	fs.SetFault(func(op string, name string) error {
+		if op == "write" && strings.HasPrefix(name, "/logs/") && atomic.LoadInt32(&fs.block) == 1 {
+			<-fs.gate
+		}
+		return nil
+	})
+	return fs
+}
+
+func (fs *stallFS) stall() {
+	atomic.StoreInt32(&fs.block, 1)
+}
+
+func (fs *stallFS) release() {
+	atomic.StoreInt32(&fs.block, 0)
+	close(fs.gate)
+}
+
+//stallEvents 收集onstall回调
+type stallEvents struct {
+	lock   sync.Mutex
+	events []StallEvent
+}
+
+func (s *stallEvents) add(event StallEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.events = append(s.events, event)
+}
+
+//wait 等待收到n个事件，返回各事件的Recovered
+func (s *stallEvents) wait(t *testing.T, n int) string {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		s.lock.Lock()
+		if len(s.events) >= n {
+			var recovered []bool
+			for _, event := range s.events {
+				recovered = append(recovered, event.Recovered)
+			}
+			s.lock.Unlock()
+			return fmt.Sprint(recovered)
+		}
+		s.lock.Unlock()
+	}
+	t.Fatalf("timeout waiting for %d stall events", n)
+	return ""
+}
+
+//waitRecovered 等待卡住的写入完成
+func waitRecovered(t *testing.T, logfile *LogFile) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		logfile.lock.Lock()
+		stalled := logfile.stalled()
+		logfile.lock.Unlock()
+		if !stalled {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("write still stalled")
+		}
+	}
+}
+
+func newWatchdogLogFile(fs *stallFS, clock Clock, policy StallPolicy, events *stallEvents) *LogFile {
+	logfile := newTestLogFile(fs.MemFS, clock)
+	logfile.SetFileSystem(fs)
+	logfile.SetFallbackPath("/fallback")
+	logfile.SetWatchdog(20*time.Millisecond, policy, events.add)
+	return logfile
+}
+
+func TestWatchdogDrop(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local))
+	fs := newStallFS(clock)
+	events := &stallEvents{}
+	logfile := newWatchdogLogFile(fs, clock, StallDrop, events)
+	logfile.Write([]byte("[LOGINF] before\n"))
+
+	fs.stall()
+	//超过threshold后放弃等待，卡住期间的日志丢弃
+	for _, line := range []string{"[LOGINF] stalled\n", "[LOGINF] dropped\n"} {
+		if n, err := logfile.Write([]byte(line)); n != len(line) || err != nil {
+			t.Fatalf("write %q: n=%d err=%v", line, n, err)
+		}
+	}
+	if got := events.wait(t, 1); got != "[false]" {
+		t.Fatalf("events %s", got)
+	}
+	fs.release()
+	//卡住的写入完成后恢复写入
+	waitRecovered(t, logfile)
+	logfile.Write([]byte("[LOGINF] after\n"))
+	logfile.Close()
+	if got := events.wait(t, 2); got != "[false true]" {
+		t.Fatalf("events %s", got)
+	}
+
+	_, contents := readSegments(t, fs.MemFS, "/logs")
+	if want := "[LOGINF] before\n[LOGINF] stalled\n[LOGINF] after\n"; string(contents[0]) != want {
+		t.Fatalf("written %q, want %q", contents[0], want)
+	}
+	if dropped := logfile.Stats().Dropped; dropped != 1 {
+		t.Fatalf("dropped %d", dropped)
+	}
+}
+
+func TestWatchdogFallback(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local))
+	fs := newStallFS(clock)
+	events := &stallEvents{}
+	logfile := newWatchdogLogFile(fs, clock, StallFallback, events)
+	logfile.Write([]byte("[LOGINF] before\n"))
+
+	fs.stall()
+	//卡住的写入和之后的写入切换到备用目录
+	for _, line := range []string{"[LOGINF] stalled\n", "[LOGINF] fallback\n"} {
+		if n, err := logfile.Write([]byte(line)); n != len(line) || err != nil {
+			t.Fatalf("write %q: n=%d err=%v", line, n, err)
+		}
+	}
+	if !logfile.Degraded() {
+		t.Fatal("not degraded")
+	}
+	fs.release()
+	//卡住的写入完成且超过退避时间后重新打开日志目录
+	waitRecovered(t, logfile)
+	clock.Advance(2 * time.Second)
+	logfile.Write([]byte("[LOGINF] after\n"))
+	if logfile.Degraded() {
+		t.Fatal("still degraded")
+	}
+	logfile.Close()
+	if got := events.wait(t, 2); got != "[false true]" {
+		t.Fatalf("events %s", got)
+	}
+
+	_, primary := readSegments(t, fs.MemFS, "/logs")
+	if want := "[LOGINF] before\n[LOGINF] stalled\n[LOGINF] after\n"; string(primary[0]) != want {
+		t.Fatalf("primary %q, want %q", primary[0], want)
+	}
+	_, fallback := readSegments(t, fs.MemFS, "/fallback")
+	if want := "[LOGINF] stalled\n[LOGINF] fallback\n"; string(fallback[0]) != want {
+		t.Fatalf("fallback %q, want %q", fallback[0], want)
+	}
+}
+
+func TestWatchdogWaitDeadline(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local))
+	fs := newStallFS(clock)
+	events := &stallEvents{}
+	logfile := newWatchdogLogFile(fs, clock, StallWait, events)
+	logfile.SetWriteDeadline(50 * time.Millisecond)
+	logfile.Write([]byte("[LOGINF] before\n"))
+
+	fs.stall()
+	//StallWait报告卡住后继续等待，超过deadline返回超时，之后的写入返回卡住直到写入完成
+	start := time.Now()
+	if _, err := logfile.Write([]byte("[LOGINF] timeout\n")); err != ErrWriteTimeout {
+		t.Fatalf("write: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("returned after %s", elapsed)
+	}
+	if got := events.wait(t, 1); got != "[false]" {
+		t.Fatalf("events %s", got)
+	}
+	if _, err := logfile.Write([]byte("[LOGINF] rejected\n")); err != ErrWriteStalled {
+		t.Fatalf("write while stalled: %v", err)
+	}
+	fs.release()
+	waitRecovered(t, logfile)
+	if _, err := logfile.Write([]byte("[LOGINF] after\n")); err != nil {
+		t.Fatal(err)
+	}
+	logfile.Close()
+
+	_, contents := readSegments(t, fs.MemFS, "/logs")
+	if want := "[LOGINF] before\n[LOGINF] timeout\n[LOGINF] after\n"; string(contents[0]) != want {
+		t.Fatalf("written %q, want %q", contents[0], want)
+	}
+}